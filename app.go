@@ -1,16 +1,13 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
-	"sync"
 	"time"
 
 	"github.com/hacdias/indieauth/v2"
@@ -21,27 +18,37 @@ type app struct {
 	*config
 	db        *database
 	oauth2    *oauth2.Config
+	trakt     *traktClient
 	indieauth *indieauth.Client
-	importMu  sync.Mutex
-	importing map[string]bool
+	jobs      *pool
+	scheduler *scheduler
+	previews  *previewCache
+	fakeTrakt *fakeTrakt
 }
 
 func newApp(config *config) (*app, error) {
 	a := &app{
 		config:    config,
-		importing: map[string]bool{},
+		jobs:      newPool(config.Concurrency),
+		scheduler: newScheduler(),
+		previews:  newPreviewCache(),
+		trakt:     newTraktClient(config.TraktAPIURL, config.TraktClientID, config.TraktRateLimit),
 		indieauth: indieauth.NewClient(config.BaseURL+"/", config.BaseURL+"/callback", nil),
 		oauth2: &oauth2.Config{
 			ClientID:     config.TraktClientID,
 			ClientSecret: config.TraktClientSecret,
 			RedirectURL:  config.BaseURL + "/trakt/callback",
 			Endpoint: oauth2.Endpoint{
-				AuthURL:  "https://trakt.tv/oauth/authorize",
-				TokenURL: "https://trakt.tv/oauth/token",
+				AuthURL:  config.TraktAuthURL + "/oauth/authorize",
+				TokenURL: config.TraktAuthURL + "/oauth/token",
 			},
 		},
 	}
 
+	if config.FakeTrakt {
+		a.fakeTrakt = newFakeTrakt()
+	}
+
 	db, err := newDatabase(config.Database)
 	if err != nil {
 		return nil, err
@@ -51,7 +58,9 @@ func newApp(config *config) (*app, error) {
 	return a, nil
 }
 
+// close waits for the running jobs to finish, and closes the database.
 func (a *app) close() error {
+	a.jobs.close()
 	return a.db.close()
 }
 
@@ -71,7 +80,24 @@ func (a *app) getTraktClient(user *user) (*http.Client, error) {
 		return nil, errors.New("user does not have trakt token")
 	}
 
-	return a.oauth2.Client(context.Background(), user.TraktToken), nil
+	ctx := context.Background()
+	ts := &persistingTokenSource{
+		src:     a.oauth2.TokenSource(ctx, user.TraktToken),
+		current: user.TraktToken,
+		onRefresh: func(tok *oauth2.Token) {
+			a.updateTokens(user, "trakt", nil, func(t *userTokens) {
+				t.TraktToken = tok
+				t.TraktTokenError = ""
+			})
+		},
+		onFailure: func(err error) {
+			a.updateTokens(user, "trakt", err, func(t *userTokens) {
+				t.TraktTokenError = err.Error()
+			})
+		},
+	}
+
+	return oauth2.NewClient(ctx, ts), nil
 }
 
 func (a *app) getMicropubClient(user *user) (*http.Client, error) {
@@ -80,7 +106,40 @@ func (a *app) getMicropubClient(user *user) (*http.Client, error) {
 		return nil, errors.New("user does not have indie token")
 	}
 
-	return oo.Client(context.Background(), user.IndieToken), nil
+	ctx := context.Background()
+	ts := &persistingTokenSource{
+		src:     oo.TokenSource(ctx, user.IndieToken),
+		current: user.IndieToken,
+		onRefresh: func(tok *oauth2.Token) {
+			a.updateTokens(user, "indie", nil, func(t *userTokens) {
+				t.IndieToken = tok
+				t.IndieTokenError = ""
+			})
+		},
+		onFailure: func(err error) {
+			a.updateTokens(user, "indie", err, func(t *userTokens) {
+				t.IndieTokenError = err.Error()
+			})
+		},
+	}
+
+	return oauth2.NewClient(ctx, ts), nil
+}
+
+// updateTokens changes the tokens of the user with fn, both in the database and
+// in our copy of the user.
+func (a *app) updateTokens(user *user, kind string, refreshErr error, fn func(t *userTokens)) {
+	if refreshErr != nil {
+		log.Printf("%s - %s token could not be refreshed, user must reconnect: %v\n", user.ProfileURL, kind, refreshErr)
+	} else {
+		log.Printf("%s - %s token was refreshed\n", user.ProfileURL, kind)
+	}
+
+	fn(&user.userTokens)
+	_, err := a.db.updateTokens(user.ProfileURL, fn)
+	if err != nil {
+		log.Printf("%s - could not save refreshed %s token: %v\n", user.ProfileURL, kind, err)
+	}
 }
 
 func (a *app) resetTrakt(user *user) error {
@@ -88,19 +147,27 @@ func (a *app) resetTrakt(user *user) error {
 	user.OldestFetchedID = 0
 	user.NewestFetchedTime = user.OldestFetchedTime
 	user.NewestFetchedID = 0
+	user.ReconcileFrom = user.OldestFetchedTime
+	user.PreLedger = false
+	user.Binge = nil
+	user.BulkImport = nil
 
-	return a.db.save(user)
-}
+	err := a.db.setBulkImport(user.ProfileURL, nil)
+	if err != nil {
+		return err
+	}
 
-func (a *app) importRequest(user *user, page int, startAt time.Time, endAt time.Time) (traktHistory, bool, error) {
-	limit := 100
-	u, err := url.Parse("https://api.trakt.tv/sync/history")
+	err = a.db.deleteDeliveries(user.ProfileURL, historyKind)
 	if err != nil {
-		return nil, false, err
+		return err
 	}
 
-	q := u.Query()
-	q.Set("limit", strconv.Itoa(limit))
+	return a.db.save(user)
+}
+
+func (a *app) importRequest(user *user, page int, startAt time.Time, endAt time.Time) (traktHistory, bool, error) {
+	q := url.Values{}
+	q.Set("limit", "100")
 	q.Set("page", strconv.Itoa(page))
 
 	if !startAt.IsZero() {
@@ -111,58 +178,136 @@ func (a *app) importRequest(user *user, page int, startAt time.Time, endAt time.
 		q.Set("end_at", endAt.Format(time.RFC3339Nano))
 	}
 
-	u.RawQuery = q.Encode()
-
-	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
-	defer cancel()
-
-	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	var history traktHistory
+	header, err := a.traktGet(user, "/sync/history", q, &history)
 	if err != nil {
 		return nil, false, err
 	}
 
-	httpClient, err := a.getTraktClient(user)
+	hasNext, err := hasNextPage(header)
 	if err != nil {
 		return nil, false, err
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Accept", "application/json")
-	req.Header.Set("trakt-api-key", a.TraktClientID)
-	req.Header.Set("trakt-api-version", "2")
+	return history, hasNext, nil
+}
 
-	res, err := httpClient.Do(req)
+// traktGet makes a request to the Trakt API on behalf of the user. If Trakt says
+// the user is no longer authorized, it is recorded so that they can reconnect.
+func (a *app) traktGet(user *user, path string, query url.Values, v interface{}) (http.Header, error) {
+	httpClient, err := a.getTraktClient(user)
 	if err != nil {
-		return nil, false, err
+		return nil, err
 	}
-	defer res.Body.Close()
 
-	currentPage, err := strconv.Atoi(res.Header.Get("X-Pagination-Page"))
-	if err != nil {
-		return nil, false, err
+	header, err := a.trakt.get(httpClient, path, query, v)
+	if errors.Is(err, errTraktUnauthorized) && user.TraktTokenError == "" {
+		a.updateTokens(user, "trakt", err, func(t *userTokens) {
+			t.TraktTokenError = err.Error()
+		})
 	}
 
-	totalPages, err := strconv.Atoi(res.Header.Get("X-Pagination-Page-Count"))
+	return header, err
+}
+
+// submit queues a job for the user, unless there is one already. The job gets a
+// freshly loaded user.
+func (a *app) submit(profileURL string, fn func(user *user)) bool {
+	return a.jobs.submit(profileURL, func() {
+		user, err := a.db.get(profileURL)
+		if err != nil {
+			log.Printf("%s - could not get user: %v\n", profileURL, err)
+			return
+		}
+
+		fn(user)
+	})
+}
+
+func (a *app) isImporting(user *user) bool {
+	return a.jobs.busy(user.ProfileURL)
+}
+
+// deliver sends an item using send, unless the ledger says it was already
+// handled, and records the outcome. It returns whether the item was handled now,
+// i.e., either sent or moved to the dead letters. An error is only returned if
+// sending should be retried later.
+func (a *app) deliver(user *user, d *delivery, send func() (string, error)) (bool, error) {
+	existing, err := a.db.getDelivery(user.ProfileURL, d.Kind, d.Key)
 	if err != nil {
-		return nil, false, err
+		return false, err
 	}
 
-	var history traktHistory
+	if existing != nil {
+		if existing.Status != deliveryFailed {
+			return false, nil
+		}
+		d = existing
+	}
 
-	err = json.NewDecoder(res.Body).Decode(&history)
-	if err != nil {
-		return nil, false, err
+	location, err := send()
+	if !isUnauthorized(err) {
+		// Otherwise, the item is not at fault: it is sent once the user reconnects.
+		d.Attempts++
+	}
+
+	if err == nil {
+		d.Status = deliveryDelivered
+		d.Location = location
+		d.Error = ""
+		a.resetBackoff(user)
+	} else if isPermanent(err) || d.Attempts >= a.MaxAttempts {
+		log.Printf("%s - moving %s %s to dead letters: %v\n", user.ProfileURL, d.Kind, d.Key, err)
+		d.Status = deliveryDead
+		d.Error = err.Error()
+		err = nil
+	} else {
+		d.Status = deliveryFailed
+		d.Error = err.Error()
+		if !isUnauthorized(err) {
+			d.RetryAt = time.Now().Add(backoffDelay(d.Attempts - 1))
+			a.backoff(user)
+		}
 	}
 
-	return history, currentPage < totalPages, nil
+	saveErr := a.db.saveDelivery(user.ProfileURL, d)
+	if saveErr != nil {
+		log.Printf("%s - could not save delivery: %v\n", user.ProfileURL, saveErr)
+	}
+
+	return err == nil, err
 }
 
-func (a *app) importTrakt(user *user, older bool, fetchNext bool) {
-	page := 1
+func (a *app) deliverHistoryItem(user *user, record traktHistoryItem) (bool, error) {
+	skipped, err := a.skipFiltered(user, record)
+	if err != nil || skipped {
+		return skipped, err
+	}
 
-	a.importMu.Lock()
-	a.importing[user.ProfileURL] = true
-	a.importMu.Unlock()
+	return a.deliver(user, newHistoryDelivery(record), func() (string, error) {
+		return a.sendMicropub(user, record)
+	})
+}
+
+// advanceWatermarks moves the newest, or oldest, fetched item to the record if
+// it is newer, or older.
+func (u *user) advanceWatermarks(record traktHistoryItem) {
+	if u.NewestFetchedTime.IsZero() || record.WatchedAt.After(u.NewestFetchedTime) {
+		u.NewestFetchedTime = record.WatchedAt
+		u.NewestFetchedID = record.ID
+	}
+
+	if u.OldestFetchedTime.IsZero() || record.WatchedAt.Before(u.OldestFetchedTime) {
+		u.OldestFetchedTime = record.WatchedAt
+		u.OldestFetchedID = record.ID
+	}
+}
+
+// importTrakt imports the newer, or older, items of the history. If limit is
+// not zero, it stops after handling that many items.
+func (a *app) importTrakt(user *user, older bool, fetchNext bool, limit int) {
+	page := 1
+	handledCount := 0
 
 	for {
 		var err error
@@ -185,7 +330,16 @@ func (a *app) importTrakt(user *user, older bool, fetchNext bool) {
 			break
 		}
 
-		failed := false
+		if !older {
+			// Trakt returns the most recent items first. When moving forward, send the
+			// oldest first so that a failure does not move the newest watermark past
+			// items that were not sent yet.
+			sort.SliceStable(history, func(i, j int) bool {
+				return history[i].WatchedAt.Before(history[j].WatchedAt)
+			})
+		}
+
+		stop := false
 
 		for _, record := range history {
 			if record.ID == newestFetchedID || record.ID == oldestFetchedID {
@@ -193,122 +347,81 @@ func (a *app) importTrakt(user *user, older bool, fetchNext bool) {
 				continue
 			}
 
-			err = a.sendMicropub(user, record)
+			var handled bool
+			if older {
+				handled, err = a.deliverHistoryItem(user, record)
+			} else {
+				handled, err = a.deliverWatch(user, record)
+			}
 			if err != nil {
-				// Stop sending more if the micropub action is not successfull. Requires user
-				// action or wait for next cron job.
+				// Stop sending more if the micropub action is not successfull. It will
+				// be retried once the user's backoff expires.
 				log.Printf("%s - could not send micropub: %v\n", user.ProfileURL, err)
-				failed = true
+				stop = true
 				break
 			}
 
-			if user.NewestFetchedTime.IsZero() || record.WatchedAt.After(user.NewestFetchedTime) {
-				user.NewestFetchedTime = record.WatchedAt
-				user.NewestFetchedID = record.ID
-			}
-
-			if user.OldestFetchedTime.IsZero() || record.WatchedAt.Before(user.OldestFetchedTime) {
-				user.OldestFetchedTime = record.WatchedAt
-				user.OldestFetchedID = record.ID
+			if !handled {
+				// Already handled, possibly by a previous import.
+				continue
 			}
 
+			user.advanceWatermarks(record)
 			err = a.db.save(user)
 			if err != nil {
-				log.Fatalf("%s - could not save user: %v\n", user.ProfileURL, err)
+				// The item was handled, so the ledger keeps us from sending it again.
+				log.Printf("%s - could not save user: %v\n", user.ProfileURL, err)
+				stop = true
+				break
+			}
+
+			handledCount++
+			if limit > 0 && handledCount >= limit {
+				// Let others have their turn. The rest is sent in the next cycle.
+				stop = true
+				break
+			}
+
+			if user.Paused {
+				// Paused meanwhile: saving got us the latest settings.
+				stop = true
 				break
 			}
 		}
 
-		if hasNext && fetchNext && !failed {
+		if hasNext && fetchNext && !stop {
 			page = page + 1
 		} else {
 			break
 		}
 	}
 
-	a.importMu.Lock()
-	defer a.importMu.Unlock()
-	a.importing[user.ProfileURL] = false
-}
-
-func (a *app) sendMicropub(user *user, item traktHistoryItem) error {
-	micro, err := traktToMicroformats(item)
-	if err != nil {
-		return err
-	}
-
-	data, err := json.Marshal(micro)
-	if err != nil {
-		return err
-	}
-
-	httpClient, err := a.getMicropubClient(user)
-	if err != nil {
-		return err
+	if !older {
+		a.flushDueBinge(user)
 	}
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*10)
-	defer cancel()
-
-	req, err := http.NewRequestWithContext(ctx, "POST", user.MicropubEndpoint, bytes.NewBuffer(data))
-	if err != nil {
-		return err
-	}
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return err
+// importCycle is what is done for each user in each scheduled import.
+func (a *app) importCycle(user *user) {
+	if !a.retryFailed(user) {
+		return
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode == http.StatusAccepted || resp.StatusCode == http.StatusCreated {
-		return nil
-	}
+	a.importTrakt(user, false, false, a.PostsPerCycle)
 
-	bodyBytes, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return err
+	if user.ImportRatings {
+		a.importRatings(user, a.PostsPerCycle)
 	}
 
-	return errors.New(user.ProfileURL +
-		": status from micropub endpoint was " +
-		strconv.Itoa(resp.StatusCode) +
-		" body: " +
-		string(bodyBytes),
-	)
-}
-
-func (a *app) importEveryone() {
-	log.Println("Running cron import")
-	users, err := a.db.getAll()
-	if err != nil {
-		log.Printf("error while getting users: %v\n", err)
+	if user.ImportWatchlist {
+		a.importWatchlist(user, a.PostsPerCycle)
 	}
 
-	for _, user := range users {
-		if user.IndieToken == nil || user.TraktToken == nil {
-			continue
-		}
-
-		a.importTrakt(user, false, false)
+	if user.ImportComments {
+		a.importComments(user, a.PostsPerCycle)
 	}
 
-	log.Println("Finished running cron import")
-}
-
-func (a *app) scheduleImports(ctx context.Context) {
-	a.importEveryone()
-
-	t := time.NewTicker(time.Minute * 30)
-	defer t.Stop()
-
-	for {
-		select {
-		case <-t.C:
-			a.importEveryone()
-		case <-ctx.Done():
-			return
-		}
+	if time.Since(user.LastReconciledAt) >= a.ReconcileInterval {
+		a.reconcileTrakt(user)
 	}
 }
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// fakeMicropub is a Micropub endpoint that keeps what it is sent. While fail is
+// positive, requests are refused with failStatus instead. Unless noLocation is
+// set, it returns the Location of the posts. It answers q=config with config,
+// and keeps the files uploaded to /media.
+type fakeMicropub struct {
+	mu         sync.Mutex
+	posts      []map[string]interface{}
+	forms      []url.Values
+	media      [][]byte
+	config     *micropubConfig
+	configs    int
+	fail       int
+	failStatus int
+	failBody   string
+	noLocation bool
+}
+
+func (m *fakeMicropub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.fail > 0 {
+		m.fail--
+		http.Error(w, m.failBody, m.failStatus)
+		return
+	}
+
+	if r.Method == http.MethodGet && r.URL.Query().Get("q") == "config" {
+		m.configs++
+		config := m.config
+		if config == nil {
+			config = &micropubConfig{}
+		}
+		writeJSON(w, http.StatusOK, config)
+		return
+	}
+
+	if r.URL.Path == "/media" {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, _ := ioutil.ReadAll(file)
+		m.media = append(m.media, data)
+		w.Header().Set("Location", fmt.Sprintf("https://me.example/media/%d", len(m.media)))
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		body, _ := ioutil.ReadAll(r.Body)
+		post := map[string]interface{}{}
+		if err := json.Unmarshal(body, &post); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		m.posts = append(m.posts, post)
+	} else {
+		if err := r.ParseMultipartForm(1 << 20); err != nil && err != http.ErrNotMultipart {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		m.forms = append(m.forms, r.Form)
+	}
+
+	if !m.noLocation {
+		w.Header().Set("Location", fmt.Sprintf("https://me.example/posts/%d", len(m.posts)+len(m.forms)))
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (m *fakeMicropub) failNext(n, status int, body string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.fail = n
+	m.failStatus = status
+	m.failBody = body
+}
+
+func (m *fakeMicropub) received() ([]map[string]interface{}, []url.Values) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.posts, m.forms
+}
+
+func (m *fakeMicropub) setConfig(config *micropubConfig) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.config = config
+}
+
+func (m *fakeMicropub) uploaded() [][]byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.media
+}
+
+// newTestApp returns an app talking to a fake Trakt and a fake Micropub
+// endpoint, and a user connected to both. The user's watermarks are twelve
+// hours ago: the seeded episodes are newer, the seeded movies are older.
+func newTestApp(t *testing.T, settings func(s *userSettings)) (*app, *fakeMicropub, *user) {
+	ft := newFakeTrakt()
+	traktServer := httptest.NewServer(ft)
+	t.Cleanup(traktServer.Close)
+
+	mp := &fakeMicropub{}
+	micropubServer := httptest.NewServer(mp)
+	t.Cleanup(micropubServer.Close)
+
+	a, err := newApp(&config{
+		BaseURL:           "http://localhost:8050",
+		Database:          filepath.Join(t.TempDir(), "database.db"),
+		TraktClientID:     "client-id",
+		TraktClientSecret: "client-secret",
+		TraktAPIURL:       traktServer.URL,
+		TraktAuthURL:      traktServer.URL,
+		TraktRateLimit:    100,
+		ReconcileDays:     30,
+		ReconcileInterval: time.Hour,
+		MaxAttempts:       3,
+		Concurrency:       2,
+		PostsPerCycle:     20,
+		DefaultInterval:   30 * time.Minute,
+		MinInterval:       10 * time.Minute,
+		MaxInterval:       24 * time.Hour,
+		BingeGap:          2 * time.Hour,
+		BingeHold:         12 * time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.fakeTrakt = ft
+	t.Cleanup(func() { a.close() })
+
+	watermark := time.Now().Add(-12 * time.Hour)
+	u := &user{
+		ProfileURL:        "https://me.example/",
+		MicropubEndpoint:  micropubServer.URL,
+		NewestFetchedTime: watermark,
+		OldestFetchedTime: watermark,
+		ReconcileFrom:     watermark,
+		userTokens: userTokens{
+			IndieToken: &oauth2.Token{AccessToken: "indie", Expiry: time.Now().Add(time.Hour)},
+			TraktToken: &oauth2.Token{AccessToken: "trakt", Expiry: time.Now().Add(time.Hour)},
+		},
+	}
+
+	err = a.db.save(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if settings != nil {
+		// Settings are only written through updateSettings.
+		_, err = a.db.updateSettings(u.ProfileURL, func(s *userSettings) {
+			settings(s)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		u, err = a.db.get(u.ProfileURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return a, mp, u
+}
+
+// historyItem returns the item of the fake Trakt history with the ID.
+func historyItem(t *testing.T, a *app, id int64) traktHistoryItem {
+	item, ok := a.fakeTrakt.find(func(item traktHistoryItem) bool {
+		return item.ID == id
+	})
+	if !ok {
+		t.Fatalf("no history item %d", id)
+	}
+
+	return item
+}
+
+func getHistoryDelivery(t *testing.T, a *app, u *user, id int64) *delivery {
+	d, err := a.db.getDelivery(u.ProfileURL, historyKind, historyKey(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return d
+}
+
+// summary returns the summary of a post sent as JSON.
+func summary(post map[string]interface{}) string {
+	properties, _ := post["properties"].(map[string]interface{})
+	summaries, _ := properties["summary"].([]interface{})
+	if len(summaries) == 0 {
+		return ""
+	}
+
+	s, _ := summaries[0].(string)
+	return s
+}
+
+func TestImportCycle(t *testing.T) {
+	a, mp, u := newTestApp(t, nil)
+
+	a.importCycle(u)
+
+	posts, _ := mp.received()
+	if len(posts) != 5 {
+		t.Fatalf("expected the 5 episodes to be posted, got %d posts", len(posts))
+	}
+
+	// Oldest first, so that a failure does not skip anything.
+	for i, post := range posts {
+		expected := fmt.Sprintf("Just watched: Episode %d (Fake Show S1E%d)", i+1, i+1)
+		if summary(post) != expected {
+			t.Errorf("expected %q, got %q", expected, summary(post))
+		}
+	}
+
+	for id := int64(4); id <= 8; id++ {
+		d := getHistoryDelivery(t, a, u, id)
+		location := fmt.Sprintf("https://me.example/posts/%d", id-3)
+		if d == nil || d.Status != deliveryDelivered || d.Location != location {
+			t.Errorf("expected item %d to be delivered to %s, got %+v", id, location, d)
+		}
+	}
+
+	stored, err := a.db.get(u.ProfileURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stored.NewestFetchedID != 8 {
+		t.Errorf("expected the newest watermark to be the last episode, got %d", stored.NewestFetchedID)
+	}
+
+	// Nothing is posted twice, but new watches are.
+	a.fakeTrakt.add(traktHistoryItem{
+		Type:      "movie",
+		Action:    "watch",
+		WatchedAt: time.Now().Add(-time.Minute).UTC().Truncate(time.Second),
+		Movie:     traktMovie{Title: "Fake Movie 4", Year: 2004, IDs: traktIDs{Trakt: 2004}},
+	})
+
+	a.importCycle(stored)
+
+	posts, _ = mp.received()
+	if len(posts) != 6 || summary(posts[5]) != "Just watched: Fake Movie 4" {
+		t.Errorf("expected only the new movie to be posted, got %d posts", len(posts))
+	}
+}
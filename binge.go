@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// bingeState holds the episodes of a binge that were not posted yet.
+type bingeState struct {
+	Items    traktHistory
+	Attempts int
+}
+
+func (b *bingeState) first() traktHistoryItem {
+	return b.Items[0]
+}
+
+func (b *bingeState) last() traktHistoryItem {
+	return b.Items[len(b.Items)-1]
+}
+
+// continues returns whether the episode can be part of the binge: it must be of
+// the same show, watched soon after the last one, and the binge must not have
+// been going on for longer than we are willing to hold it.
+func (b *bingeState) continues(item traktHistoryItem, gap, hold time.Duration) bool {
+	return item.Type == "episode" &&
+		item.Show.IDs.Trakt == b.first().Show.IDs.Trakt &&
+		item.WatchedAt.Sub(b.last().WatchedAt) <= gap &&
+		item.WatchedAt.Sub(b.first().WatchedAt) <= hold
+}
+
+// deliverWatch delivers a new watch, holding it back if it is an episode that
+// may be part of a binge.
+func (a *app) deliverWatch(user *user, record traktHistoryItem) (bool, error) {
+	if user.Binge != nil && !user.Binge.continues(record, a.BingeGap, a.BingeHold) {
+		err := a.flushBinge(user)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	if !user.AggregateBinges || record.Type != "episode" {
+		return a.deliverHistoryItem(user, record)
+	}
+
+	skipped, err := a.skipFiltered(user, record)
+	if err != nil || skipped {
+		return skipped, err
+	}
+
+	existing, err := a.db.getDelivery(user.ProfileURL, historyKind, historyKey(record.ID))
+	if err != nil {
+		return false, err
+	}
+
+	if existing != nil {
+		return false, nil
+	}
+
+	d := newHistoryDelivery(record)
+	d.Status = deliveryHeld
+	err = a.db.saveDelivery(user.ProfileURL, d)
+	if err != nil {
+		return false, err
+	}
+
+	if user.Binge == nil {
+		user.Binge = &bingeState{}
+	}
+	user.Binge.Items = append(user.Binge.Items, record)
+	return true, nil
+}
+
+// flushDueBinge posts the held binge once no more episodes can be added to it,
+// or it was held for too long.
+func (a *app) flushDueBinge(user *user) {
+	b := user.Binge
+	if b == nil || time.Now().Before(user.RetryAt) {
+		return
+	}
+
+	now := time.Now()
+	if user.AggregateBinges && now.Sub(b.last().WatchedAt) <= a.BingeGap && now.Sub(b.first().WatchedAt) <= a.BingeHold {
+		// Still binging.
+		return
+	}
+
+	err := a.flushBinge(user)
+	if err != nil {
+		log.Printf("%s - could not send micropub: %v\n", user.ProfileURL, err)
+	}
+}
+
+// flushBinge posts the held binge and records the outcome for each of its
+// episodes. An error is only returned if it should be retried later, in which
+// case the binge is kept.
+func (a *app) flushBinge(user *user) error {
+	b := user.Binge
+	if b == nil {
+		return nil
+	}
+
+	location, err := a.sendBinge(user, b.Items)
+	if isUnauthorized(err) {
+		// Kept as it is until the user reconnects.
+		return err
+	}
+	b.Attempts++
+
+	status := deliveryDelivered
+	errMsg := ""
+	if err == nil {
+		a.resetBackoff(user)
+	} else if isPermanent(err) || b.Attempts >= a.MaxAttempts {
+		log.Printf("%s - moving binge of %s to dead letters: %v\n", user.ProfileURL, b.first().Show.Title, err)
+		status = deliveryDead
+		errMsg = err.Error()
+	} else {
+		a.backoff(user)
+		return err
+	}
+
+	for _, item := range b.Items {
+		d, err := a.db.getDelivery(user.ProfileURL, historyKind, historyKey(item.ID))
+		if err != nil {
+			log.Printf("%s - could not get delivery: %v\n", user.ProfileURL, err)
+			continue
+		}
+
+		if d == nil {
+			d = newHistoryDelivery(item)
+		}
+
+		d.Status = status
+		d.Location = location
+		d.Error = errMsg
+		d.Attempts = b.Attempts
+		// Deleting the post would also delete the other episodes.
+		d.Aggregated = len(b.Items) > 1
+
+		err = a.db.saveDelivery(user.ProfileURL, d)
+		if err != nil {
+			log.Printf("%s - could not save delivery: %v\n", user.ProfileURL, err)
+		}
+	}
+
+	user.Binge = nil
+	err = a.db.save(user)
+	if err != nil {
+		log.Printf("%s - could not save user: %v\n", user.ProfileURL, err)
+	}
+
+	return nil
+}
+
+// sendBinge posts the episodes as a single post, unless there is only one.
+func (a *app) sendBinge(user *user, items traktHistory) (string, error) {
+	if len(items) == 1 {
+		return a.sendMicropub(user, items[0])
+	}
+
+	micro, err := traktBingeToMicroformats(items)
+	if err != nil {
+		return "", &conversionError{err}
+	}
+
+	applyPostRule(user.PostRules, "episode", micro)
+	return a.finishWatches(user, items, micro)
+}
+
+// bingeRange describes the episodes of a binge, e.g., S2E1–E8 or S1E9–S2E2.
+func bingeRange(items traktHistory) string {
+	first := items[0].Episode
+	last := items[len(items)-1].Episode
+
+	if first.Season == last.Season {
+		return fmt.Sprintf("S%dE%d–E%d", first.Season, first.Number, last.Number)
+	}
+
+	return fmt.Sprintf("S%dE%d–S%dE%d", first.Season, first.Number, last.Season, last.Number)
+}
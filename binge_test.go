@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBingeContinues(t *testing.T) {
+	now := time.Now()
+	episode := func(show int, watchedAt time.Time) traktHistoryItem {
+		return traktHistoryItem{
+			Type:      "episode",
+			WatchedAt: watchedAt,
+			Show:      traktShow{IDs: traktIDs{Trakt: show}},
+		}
+	}
+
+	b := &bingeState{Items: traktHistory{episode(1, now.Add(-3*time.Hour)), episode(1, now.Add(-2*time.Hour))}}
+
+	tests := []struct {
+		item     traktHistoryItem
+		expected bool
+	}{
+		{episode(1, now.Add(-time.Hour)), true},
+		{episode(2, now.Add(-time.Hour)), false},
+		{traktHistoryItem{Type: "movie", WatchedAt: now.Add(-time.Hour)}, false},
+		// Too long after the last episode.
+		{episode(1, now.Add(time.Hour)), false},
+	}
+
+	for _, test := range tests {
+		if got := b.continues(test.item, 2*time.Hour, 12*time.Hour); got != test.expected {
+			t.Errorf("%s of show %d: expected %v, got %v", test.item.Type, test.item.Show.IDs.Trakt, test.expected, got)
+		}
+	}
+
+	if b.continues(episode(1, now.Add(-time.Hour)), 2*time.Hour, time.Hour) {
+		t.Error("expected the binge not to be held for longer than the hold")
+	}
+}
+
+func TestBingeHeldAndFlushed(t *testing.T) {
+	a, mp, u := newTestApp(t, func(s *userSettings) {
+		s.AggregateBinges = true
+	})
+
+	a.importTrakt(u, false, false, 0)
+
+	posts, _ := mp.received()
+	if len(posts) != 0 {
+		t.Fatalf("expected the binge to be held, got %d posts", len(posts))
+	}
+
+	if u.Binge == nil || len(u.Binge.Items) != 5 {
+		t.Fatalf("expected the 5 episodes to be held, got %+v", u.Binge)
+	}
+
+	if d := getHistoryDelivery(t, a, u, 4); d == nil || d.Status != deliveryHeld {
+		t.Errorf("expected the episode to be held, got %+v", d)
+	}
+
+	// The last episode was an hour ago, within the gap.
+	a.flushDueBinge(u)
+	if u.Binge == nil {
+		t.Fatal("expected the binge to be held while it may continue")
+	}
+
+	a.BingeGap = 30 * time.Minute
+	a.flushDueBinge(u)
+
+	posts, _ = mp.received()
+	if len(posts) != 1 || u.Binge != nil {
+		t.Fatalf("expected the binge to be posted once, got %d posts", len(posts))
+	}
+
+	for id := int64(4); id <= 8; id++ {
+		d := getHistoryDelivery(t, a, u, id)
+		if d == nil || d.Status != deliveryDelivered || !d.Aggregated || d.Location != "https://me.example/posts/1" {
+			t.Errorf("expected item %d to be delivered with the binge, got %+v", id, d)
+		}
+	}
+
+	stored, err := a.db.get(u.ProfileURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stored.Binge != nil {
+		t.Error("expected the binge to be cleared once posted")
+	}
+}
+
+func TestBingeFlushedByOtherWatch(t *testing.T) {
+	a, mp, u := newTestApp(t, func(s *userSettings) {
+		s.AggregateBinges = true
+	})
+
+	a.importTrakt(u, false, false, 0)
+
+	movie := a.fakeTrakt.add(traktHistoryItem{
+		Type:      "movie",
+		Action:    "watch",
+		WatchedAt: time.Now().Add(-time.Minute).UTC().Truncate(time.Second),
+		Movie:     traktMovie{Title: "Fake Movie 4", Year: 2004, IDs: traktIDs{Trakt: 2004}},
+	})[0]
+
+	handled, err := a.deliverWatch(u, movie)
+	if err != nil || !handled {
+		t.Fatalf("expected the movie to be posted, got %v", err)
+	}
+
+	posts, _ := mp.received()
+	if len(posts) != 2 || u.Binge != nil {
+		t.Errorf("expected the binge to be posted before the movie, got %d posts", len(posts))
+	}
+}
+
+func TestBingeFlushRetries(t *testing.T) {
+	a, mp, u := newTestApp(t, func(s *userSettings) {
+		s.AggregateBinges = true
+	})
+
+	a.importTrakt(u, false, false, 0)
+
+	mp.failNext(1, http.StatusInternalServerError, "down")
+	if err := a.flushBinge(u); err == nil {
+		t.Fatal("expected the flush to be retried later")
+	}
+
+	if u.Binge == nil || u.Binge.Attempts != 1 || u.RetryAt.IsZero() {
+		t.Fatalf("expected the binge to be kept and the user to back off, got %+v", u.Binge)
+	}
+
+	mp.failNext(1, http.StatusBadRequest, "invalid")
+	if err := a.flushBinge(u); err != nil {
+		t.Fatal(err)
+	}
+
+	if d := getHistoryDelivery(t, a, u, 4); d == nil || d.Status != deliveryDead || d.Attempts != 2 {
+		t.Errorf("expected the episode to be a dead letter, got %+v", d)
+	}
+}
+
+func TestBingeKeptWhenUnauthorized(t *testing.T) {
+	a, mp, u := newTestApp(t, func(s *userSettings) {
+		s.AggregateBinges = true
+	})
+
+	a.importTrakt(u, false, false, 0)
+
+	mp.failNext(1, http.StatusUnauthorized, "invalid token")
+	if err := a.flushBinge(u); err == nil {
+		t.Fatal("expected the binge to be kept")
+	}
+
+	if u.Binge == nil || u.Binge.Attempts != 0 || u.IndieTokenError == "" {
+		t.Errorf("expected the binge to wait for the user to reconnect, got %+v", u.Binge)
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// bulkImport is the progress of importing the user's whole history, oldest
+// first. Watches after EndAt, i.e., after the import started, are left to the
+// regular imports, and so are those between SkipFrom and SkipTo, which were
+// imported before there was a ledger: they may have been posted without being
+// recorded.
+type bulkImport struct {
+	PerHour  int
+	EndAt    time.Time
+	SkipFrom time.Time
+	SkipTo   time.Time
+	Cursor   time.Time
+	// CursorIDs are the items watched at Cursor that were handled already.
+	CursorIDs  []int64
+	Done       int
+	Total      int
+	NextAt     time.Time
+	StartedAt  time.Time
+	FinishedAt time.Time
+}
+
+func (b *bulkImport) finished() bool {
+	return !b.FinishedAt.IsZero()
+}
+
+func (b *bulkImport) atCursor(record traktHistoryItem) bool {
+	if !record.WatchedAt.Equal(b.Cursor) {
+		return false
+	}
+
+	for _, id := range b.CursorIDs {
+		if id == record.ID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// advance moves the cursor past the item.
+func (b *bulkImport) advance(record traktHistoryItem) {
+	if !record.WatchedAt.Equal(b.Cursor) {
+		b.Cursor = record.WatchedAt
+		b.CursorIDs = nil
+	}
+
+	b.CursorIDs = append(b.CursorIDs, record.ID)
+	b.Done++
+}
+
+func (b *bulkImport) skips(record traktHistoryItem) bool {
+	return !record.WatchedAt.Before(b.SkipFrom) && record.WatchedAt.Before(b.SkipTo)
+}
+
+// startBulkImport starts importing the user's whole history at perHour posts
+// per hour, replacing any previous bulk import.
+func (a *app) startBulkImport(user *user, perHour int) error {
+	now := time.Now()
+	user.BulkImport = &bulkImport{
+		PerHour:   perHour,
+		EndAt:     now,
+		NextAt:    now,
+		StartedAt: now,
+	}
+
+	// Like in reconcileTrakt: everything else is in the ledger.
+	from := user.reconcileFrom()
+	if user.PreLedger {
+		user.BulkImport.SkipFrom = user.OldestFetchedTime
+		user.BulkImport.SkipTo = from
+	}
+
+	err := a.db.setBulkImport(user.ProfileURL, user.BulkImport)
+	if err != nil {
+		return err
+	}
+
+	a.submit(user.ProfileURL, a.bulkImportStep)
+	return nil
+}
+
+// oldestHistory returns the oldest items of the history between startAt and
+// endAt, at least a page of them if there are enough, oldest first, and how
+// many items there are in total.
+func (a *app) oldestHistory(user *user, startAt, endAt time.Time) (traktHistory, int, error) {
+	q := url.Values{}
+	q.Set("limit", "100")
+	q.Set("page", "1")
+	q.Set("end_at", endAt.Format(time.RFC3339Nano))
+
+	if !startAt.IsZero() {
+		q.Set("start_at", startAt.Format(time.RFC3339Nano))
+	}
+
+	var history traktHistory
+	header, err := a.traktGet(user, "/sync/history", q, &history)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	itemCount, err := strconv.Atoi(header.Get("X-Pagination-Item-Count"))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	pageCount, err := strconv.Atoi(header.Get("X-Pagination-Page-Count"))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if pageCount > 1 {
+		// Trakt returns the most recent items first: the oldest are in the last page.
+		// If it is not full, the page before is also needed, or we could be left
+		// with the cursor alone.
+		history = nil
+		for page := pageCount; page >= 1 && len(history) < 100; page-- {
+			var items traktHistory
+			q.Set("page", strconv.Itoa(page))
+			_, err = a.traktGet(user, "/sync/history", q, &items)
+			if err != nil {
+				return nil, 0, err
+			}
+
+			history = append(history, items...)
+		}
+	}
+
+	sort.SliceStable(history, func(i, j int) bool {
+		return history[i].WatchedAt.Before(history[j].WatchedAt)
+	})
+
+	return history, itemCount, nil
+}
+
+// skippedAhead returns how many of the items the bulk import skips are still
+// ahead of its cursor, which Trakt counts in the total.
+func (a *app) skippedAhead(user *user, b *bulkImport) (int, error) {
+	if !b.SkipFrom.Before(b.SkipTo) || !b.Cursor.Before(b.SkipTo) {
+		return 0, nil
+	}
+
+	q := url.Values{}
+	q.Set("limit", "1")
+	q.Set("start_at", b.SkipFrom.Format(time.RFC3339Nano))
+	// end_at includes the items watched at SkipTo, which are not skipped.
+	q.Set("end_at", b.SkipTo.Add(-time.Millisecond).Format(time.RFC3339Nano))
+
+	var history traktHistory
+	header, err := a.traktGet(user, "/sync/history", q, &history)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(header.Get("X-Pagination-Item-Count"))
+}
+
+// bulkImportStep sends the next items of the user's bulk import, as many as
+// their posts per hour allow until the next step. Only posts count: items
+// skipped by the rules, or moved to the dead letters, do not. The cursor is
+// saved after each item, so that the import resumes where it stopped.
+func (a *app) bulkImportStep(user *user) {
+	b := user.BulkImport
+	now := time.Now()
+	if b == nil || b.finished() || now.Before(b.NextAt) || now.Before(user.RetryAt) {
+		return
+	}
+
+	history, remaining, err := a.oldestHistory(user, b.Cursor, b.EndAt)
+	if err != nil {
+		log.Printf("%s - could not fetch trakt: %v\n", user.ProfileURL, err)
+		return
+	}
+
+	skipped, err := a.skippedAhead(user, b)
+	if err != nil {
+		log.Printf("%s - could not fetch trakt: %v\n", user.ProfileURL, err)
+		return
+	}
+
+	spacing := time.Hour / time.Duration(b.PerHour)
+	budget := int(a.BulkInterval / spacing)
+	if budget < 1 {
+		budget = 1
+	}
+
+	posted := 0
+	failed := false
+	jumped := false
+
+	for _, record := range history {
+		if b.atCursor(record) {
+			// The cursor is included, as start_at is.
+			remaining--
+			continue
+		}
+
+		if posted >= budget {
+			break
+		}
+
+		if b.skips(record) {
+			// Jump over them: they are not part of the total either.
+			b.Cursor = b.SkipTo
+			b.CursorIDs = nil
+			jumped = true
+			break
+		}
+
+		handled, err := a.deliverHistoryItem(user, record)
+		if err != nil {
+			// It will be retried once the user's backoff expires.
+			log.Printf("%s - could not send micropub: %v\n", user.ProfileURL, err)
+			failed = true
+			break
+		}
+
+		if handled {
+			user.advanceWatermarks(record)
+
+			d, err := a.db.getDelivery(user.ProfileURL, historyKind, historyKey(record.ID))
+			if err != nil {
+				log.Printf("%s - could not get delivery: %v\n", user.ProfileURL, err)
+				return
+			}
+
+			if d != nil && d.Status == deliveryDelivered {
+				posted++
+			}
+		}
+
+		b.advance(record)
+		remaining--
+
+		err = a.db.save(user)
+		if err != nil {
+			log.Printf("%s - could not save user: %v\n", user.ProfileURL, err)
+			return
+		}
+
+		if user.BulkImport != b || user.Paused {
+			// Cancelled, restarted or paused meanwhile.
+			return
+		}
+	}
+
+	b.NextAt = time.Now().Add(time.Duration(posted) * spacing)
+	b.Total = b.Done + remaining - skipped
+	if remaining <= 0 && !failed && !jumped {
+		b.FinishedAt = time.Now()
+	}
+
+	err = a.db.save(user)
+	if err != nil {
+		log.Printf("%s - could not save user: %v\n", user.ProfileURL, err)
+	}
+}
+
+// pollBulkImports continues the bulk imports in progress every bulk interval,
+// until the context is done.
+func (a *app) pollBulkImports(ctx context.Context) {
+	ticker := time.NewTicker(a.BulkInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		users, err := a.db.getAll()
+		if err != nil {
+			log.Printf("error while getting users: %v\n", err)
+			continue
+		}
+
+		now := time.Now()
+		for _, user := range users {
+			canImport := user.BulkImport != nil && !user.BulkImport.finished() &&
+				!now.Before(user.BulkImport.NextAt) && !user.Paused &&
+				user.IndieToken != nil && user.TraktToken != nil &&
+				user.IndieTokenError == "" && user.TraktTokenError == ""
+
+			if canImport {
+				// Skipped if the user is being imported. We will try again soon.
+				a.submit(user.ProfileURL, a.bulkImportStep)
+			}
+		}
+	}
+}
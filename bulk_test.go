@@ -0,0 +1,160 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// waitBulkImport waits for the step of the bulk import running in the pool to
+// end, and returns the user.
+func waitBulkImport(t *testing.T, a *app, u *user) *user {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		stored, err := a.db.get(u.ProfileURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if stored.BulkImport != nil && stored.BulkImport.Total != 0 {
+			return stored
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("the bulk import did not run")
+	return nil
+}
+
+// nextBulkImportStep runs the next step of the bulk import right away.
+func nextBulkImportStep(t *testing.T, a *app, u *user) *user {
+	t.Helper()
+
+	stored, err := a.db.updateUser(u.ProfileURL, func(u *user) {
+		u.BulkImport.NextAt = time.Time{}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.bulkImportStep(stored)
+
+	stored, err = a.db.get(u.ProfileURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return stored
+}
+
+func TestBulkImport(t *testing.T) {
+	a, mp, u := newTestApp(t, nil)
+	a.BulkInterval = time.Hour
+
+	err := a.startBulkImport(u, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored := waitBulkImport(t, a, u)
+
+	posts, _ := mp.received()
+	if len(posts) != 8 {
+		t.Fatalf("expected the whole history to be posted, got %d posts", len(posts))
+	}
+
+	// Oldest first.
+	if summary(posts[0]) != "Just watched: Fake Movie 3" || summary(posts[7]) != "Just watched: Episode 5 (Fake Show S1E5)" {
+		t.Errorf("expected the oldest watch first, got %q and %q", summary(posts[0]), summary(posts[7]))
+	}
+
+	b := stored.BulkImport
+	if b.Done != 8 || b.Total != 8 || !b.finished() {
+		t.Errorf("expected 8 of 8 watches to be done, got %+v", b)
+	}
+
+	if !stored.OldestFetchedTime.Equal(historyItem(t, a, 3).WatchedAt) {
+		t.Errorf("expected the oldest watermark to move, got %s", stored.OldestFetchedTime)
+	}
+}
+
+func TestBulkImportPerHour(t *testing.T) {
+	a, mp, u := newTestApp(t, nil)
+	a.BulkInterval = time.Hour
+
+	err := a.startBulkImport(u, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored := waitBulkImport(t, a, u)
+
+	posts, _ := mp.received()
+	if len(posts) != 3 {
+		t.Fatalf("expected 3 posts in the first hour, got %d", len(posts))
+	}
+
+	b := stored.BulkImport
+	if b.Done != 3 || b.Total != 8 || b.finished() || time.Until(b.NextAt) < 50*time.Minute {
+		t.Errorf("expected the import to go on in an hour, got %+v", b)
+	}
+
+	// Resumes from the cursor.
+	stored = nextBulkImportStep(t, a, stored)
+
+	posts, _ = mp.received()
+	if len(posts) != 6 || summary(posts[3]) != "Just watched: Episode 1 (Fake Show S1E1)" {
+		t.Errorf("expected the episodes after the movies, got %d posts", len(posts))
+	}
+
+	if stored.BulkImport.Done != 6 || stored.BulkImport.Total != 8 {
+		t.Errorf("expected 6 of 8 watches to be done, got %+v", stored.BulkImport)
+	}
+}
+
+func TestBulkImportPreLedger(t *testing.T) {
+	a, mp, u := newTestApp(t, nil)
+	a.BulkInterval = time.Hour
+
+	// Fake Movie 1, watched a day ago, was imported before the ledger existed.
+	u, err := a.db.updateUser(u.ProfileURL, func(u *user) {
+		u.OldestFetchedTime = time.Now().Add(-36 * time.Hour)
+		u.ReconcileFrom = time.Time{}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = a.startBulkImport(u, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored := waitBulkImport(t, a, u)
+
+	for i := 0; i < 20 && !stored.BulkImport.finished(); i++ {
+		// The skipped watch is never part of the total.
+		if stored.BulkImport.Total != 7 {
+			t.Fatalf("expected a total of 7 watches, got %+v", stored.BulkImport)
+		}
+
+		stored = nextBulkImportStep(t, a, stored)
+	}
+
+	posts, _ := mp.received()
+	if len(posts) != 7 {
+		t.Fatalf("expected 7 posts, got %d", len(posts))
+	}
+
+	for _, post := range posts {
+		if summary(post) == "Just watched: Fake Movie 1" {
+			t.Error("expected the watch from before the ledger to be skipped")
+		}
+	}
+
+	if b := stored.BulkImport; !b.finished() || b.Done != 7 || b.Total != 7 {
+		t.Errorf("expected 7 of 7 watches to be done, got %+v", b)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"log"
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+func commentKey(id int64) string {
+	return strconv.FormatInt(id, 10)
+}
+
+func newCommentDelivery(item traktCommentItem) *delivery {
+	return &delivery{
+		Key:     commentKey(item.Comment.ID),
+		Kind:    commentsKind,
+		Title:   item.title(),
+		Date:    item.Comment.CreatedAt,
+		Comment: &item,
+	}
+}
+
+func (a *app) deliverComment(user *user, item traktCommentItem) (bool, error) {
+	return a.deliver(user, newCommentDelivery(item), func() (string, error) {
+		micro, err := traktCommentToMicroformats(item)
+		if err != nil {
+			return "", &conversionError{err}
+		}
+
+		return a.createMicropub(user, micro)
+	})
+}
+
+// fetchComments fetches the user's comments, most recent first, until it finds
+// one that was created before the last imported one.
+func (a *app) fetchComments(user *user) (traktComments, error) {
+	all := traktComments{}
+
+	for page := 1; ; page++ {
+		q := url.Values{}
+		q.Set("limit", "100")
+		q.Set("page", strconv.Itoa(page))
+
+		var comments traktComments
+		header, err := a.traktGet(user, "/users/me/comments/all/all", q, &comments)
+		if err != nil {
+			return nil, err
+		}
+
+		all = append(all, comments...)
+
+		hasNext, err := hasNextPage(header)
+		if err != nil {
+			return nil, err
+		}
+
+		if !hasNext || len(comments) == 0 ||
+			comments[len(comments)-1].Comment.CreatedAt.Before(user.CommentsFetchedTime) {
+			return all, nil
+		}
+	}
+}
+
+// importComments sends the comments written since the last imported one, oldest
+// first. If limit is not zero, it stops after handling that many comments.
+func (a *app) importComments(user *user, limit int) {
+	comments, err := a.fetchComments(user)
+	if err != nil {
+		log.Printf("%s - could not fetch trakt comments: %v\n", user.ProfileURL, err)
+		return
+	}
+
+	sort.SliceStable(comments, func(i, j int) bool {
+		return comments[i].Comment.CreatedAt.Before(comments[j].Comment.CreatedAt)
+	})
+
+	handledCount := 0
+
+	for _, comment := range comments {
+		if comment.Comment.CreatedAt.Before(user.CommentsFetchedTime) {
+			continue
+		}
+
+		if comment.Type == "list" {
+			// We only know how to reply to movies, shows, seasons and episodes.
+			continue
+		}
+
+		handled, err := a.deliverComment(user, comment)
+		if err != nil {
+			log.Printf("%s - could not send micropub: %v\n", user.ProfileURL, err)
+			return
+		}
+
+		if !handled {
+			continue
+		}
+
+		user.CommentsFetchedTime = comment.Comment.CreatedAt
+
+		err = a.db.save(user)
+		if err != nil {
+			log.Printf("%s - could not save user: %v\n", user.ProfileURL, err)
+			return
+		}
+
+		handledCount++
+		if limit > 0 && handledCount >= limit {
+			return
+		}
+	}
+}
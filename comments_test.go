@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestImportComments(t *testing.T) {
+	a, mp, u := newTestApp(t, func(s *userSettings) {
+		s.ImportComments = true
+	})
+	u = startImportsAt(t, a, u, time.Now().Add(-2*time.Hour))
+
+	movie := historyItem(t, a, 1).Movie
+	a.fakeTrakt.mu.Lock()
+	a.fakeTrakt.comments = append(a.fakeTrakt.comments,
+		traktCommentItem{
+			Type:    "movie",
+			Movie:   movie,
+			Comment: traktComment{ID: 100, ParentID: 99, CreatedAt: time.Now().Add(-20 * time.Minute), Comment: "I agree!"},
+		},
+		traktCommentItem{
+			Type:    "list",
+			Comment: traktComment{ID: 101, CreatedAt: time.Now().Add(-10 * time.Minute), Comment: "Nice list."},
+		},
+	)
+	a.fakeTrakt.mu.Unlock()
+
+	a.importComments(u, 0)
+	a.importComments(u, 0)
+
+	posts, _ := mp.received()
+	if len(posts) != 2 {
+		t.Fatalf("expected the comments on the episode and the movie to be posted once, got %d posts", len(posts))
+	}
+
+	replyTo := property(posts[0], "in-reply-to")
+	if len(replyTo) != 1 || replyTo[0] != "https://trakt.tv/shows/fake-show/seasons/1/episodes/1" {
+		t.Errorf("expected a reply to the episode, got %v", replyTo)
+	}
+
+	if categories := property(posts[0], "category"); len(categories) != 1 || categories[0] != "spoiler" {
+		t.Errorf("expected the spoiler to be categorised, got %v", categories)
+	}
+
+	replyTo = property(posts[1], "in-reply-to")
+	if len(replyTo) != 1 || replyTo[0] != "https://trakt.tv/comments/99" {
+		t.Errorf("expected a reply to the parent comment, got %v", replyTo)
+	}
+
+	d, err := a.db.getDelivery(u.ProfileURL, commentsKind, commentKey(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d == nil || d.Status != deliveryDelivered {
+		t.Errorf("expected the comment to be in the ledger, got %+v", d)
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"errors"
+	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 )
@@ -14,6 +16,26 @@ type config struct {
 	DisableSignups    bool
 	TraktClientID     string
 	TraktClientSecret string
+	TraktAPIURL       string
+	TraktAuthURL      string
+	FakeTrakt         bool
+	TraktRateLimit    float64
+	ReconcileDays     int
+	ReconcileInterval time.Duration
+	MaxAttempts       int
+	Concurrency       int
+	PostsPerCycle     int
+	DefaultInterval   time.Duration
+	MinInterval       time.Duration
+	MaxInterval       time.Duration
+	WatchingInterval  time.Duration
+	BingeGap          time.Duration
+	BingeHold         time.Duration
+	BulkInterval      time.Duration
+	MaxPostsPerHour   int
+	TMDbAPIKey        string
+	TMDbAPIURL        string
+	TMDbImageURL      string
 }
 
 func getConfig() (*config, error) {
@@ -23,6 +45,24 @@ func getConfig() (*config, error) {
 	viper.SetDefault("port", 8050)
 	viper.SetDefault("baseUrl", "http://localhost:8050")
 	viper.SetDefault("database", "./database.db")
+	viper.SetDefault("traktApiUrl", "https://api.trakt.tv")
+	viper.SetDefault("traktAuthUrl", "https://trakt.tv")
+	viper.SetDefault("traktRateLimit", 3)
+	viper.SetDefault("reconcileDays", 30)
+	viper.SetDefault("reconcileInterval", "24h")
+	viper.SetDefault("maxAttempts", 5)
+	viper.SetDefault("concurrency", 4)
+	viper.SetDefault("postsPerCycle", 20)
+	viper.SetDefault("defaultInterval", "30m")
+	viper.SetDefault("minInterval", "10m")
+	viper.SetDefault("maxInterval", "24h")
+	viper.SetDefault("watchingInterval", "2m")
+	viper.SetDefault("bingeGap", "1h")
+	viper.SetDefault("bingeHold", "6h")
+	viper.SetDefault("bulkInterval", "1m")
+	viper.SetDefault("maxPostsPerHour", 120)
+	viper.SetDefault("tmdbApiUrl", "https://api.themoviedb.org/3")
+	viper.SetDefault("tmdbImageUrl", "https://image.tmdb.org/t/p/w500")
 
 	err := viper.ReadInConfig()
 	if err != nil {
@@ -35,6 +75,47 @@ func getConfig() (*config, error) {
 		return nil, err
 	}
 
+	if conf.FakeTrakt {
+		// The fake Trakt is served by ourselves, under /fake-trakt.
+		conf.TraktAPIURL = conf.BaseURL + fakeTraktPrefix
+		conf.TraktAuthURL = conf.BaseURL + fakeTraktPrefix
+		conf.TMDbAPIURL = conf.BaseURL + fakeTraktPrefix + "/tmdb"
+		conf.TMDbImageURL = conf.BaseURL + fakeTraktPrefix + "/tmdb/images"
+	}
+
+	conf.TraktAPIURL = strings.TrimSuffix(conf.TraktAPIURL, "/")
+	conf.TraktAuthURL = strings.TrimSuffix(conf.TraktAuthURL, "/")
+	conf.TMDbAPIURL = strings.TrimSuffix(conf.TMDbAPIURL, "/")
+	conf.TMDbImageURL = strings.TrimSuffix(conf.TMDbImageURL, "/")
+
+	if conf.MinInterval <= 0 || conf.MinInterval > conf.MaxInterval {
+		return nil, errors.New("minInterval must be positive and smaller than maxInterval")
+	}
+
+	if conf.DefaultInterval < conf.MinInterval || conf.DefaultInterval > conf.MaxInterval {
+		return nil, errors.New("defaultInterval must be between minInterval and maxInterval")
+	}
+
+	if conf.WatchingInterval <= 0 {
+		return nil, errors.New("watchingInterval must be positive")
+	}
+
+	if conf.BingeGap <= 0 || conf.BingeHold <= 0 {
+		return nil, errors.New("bingeGap and bingeHold must be positive")
+	}
+
+	if conf.BulkInterval <= 0 || conf.MaxPostsPerHour <= 0 {
+		return nil, errors.New("bulkInterval and maxPostsPerHour must be positive")
+	}
+
+	if conf.Concurrency <= 0 {
+		return nil, errors.New("concurrency must be positive")
+	}
+
+	if conf.TraktRateLimit <= 0 {
+		return nil, errors.New("traktRateLimit must be positive")
+	}
+
 	if conf.TraktClientID == "" {
 		return nil, errors.New("traktClientId must be defined")
 	}
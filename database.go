@@ -2,6 +2,8 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"time"
 
 	bolt "go.etcd.io/bbolt"
 )
@@ -64,6 +66,9 @@ func (d *database) getAll() ([]*user, error) {
 	return users, err
 }
 
+// save stores the user. The tokens and the settings are kept as they are in the
+// database, and copied to u: use updateTokens and updateSettings to change them.
+// Likewise, the bulk import is only saved if it was not cancelled or restarted.
 func (d *database) save(u *user) error {
 	return d.db.Update(func(tx *bolt.Tx) error {
 		b, err := tx.CreateBucketIfNotExists([]byte("users"))
@@ -71,13 +76,114 @@ func (d *database) save(u *user) error {
 			return err
 		}
 
-		encoded, err := json.Marshal(u)
+		if v := b.Get([]byte(u.ProfileURL)); v != nil {
+			stored := &user{}
+			err = json.Unmarshal(v, stored)
+			if err != nil {
+				return err
+			}
+
+			u.userTokens = stored.userTokens
+			u.userSettings = stored.userSettings
+
+			// Imports that were enabled meanwhile start from when they were enabled.
+			u.RatingsFetchedTime = latest(u.RatingsFetchedTime, stored.RatingsFetchedTime)
+			u.WatchlistFetchedTime = latest(u.WatchlistFetchedTime, stored.WatchlistFetchedTime)
+			u.CommentsFetchedTime = latest(u.CommentsFetchedTime, stored.CommentsFetchedTime)
+
+			if u.BulkImport == nil || stored.BulkImport == nil || !u.BulkImport.StartedAt.Equal(stored.BulkImport.StartedAt) {
+				u.BulkImport = stored.BulkImport
+			}
+		}
+
+		return putUser(b, u)
+	})
+}
+
+func latest(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+
+	return b
+}
+
+// updateUser loads the user, changes it with fn and stores it in a single
+// transaction, so that only what fn changes is changed.
+func (d *database) updateUser(profileURL string, fn func(u *user)) (*user, error) {
+	u := &user{}
+
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("users"))
+		if err != nil {
+			return err
+		}
+
+		v := b.Get([]byte(profileURL))
+		if v == nil {
+			return errors.New("user not found")
+		}
+
+		err = json.Unmarshal(v, u)
 		if err != nil {
 			return err
 		}
 
-		return b.Put([]byte(u.ProfileURL), encoded)
+		fn(u)
+		return putUser(b, u)
+	})
+
+	return u, err
+}
+
+// updateTokens changes the tokens of the user with fn and returns them.
+func (d *database) updateTokens(profileURL string, fn func(t *userTokens)) (userTokens, error) {
+	u, err := d.updateUser(profileURL, func(u *user) {
+		fn(&u.userTokens)
+	})
+	if err != nil {
+		return userTokens{}, err
+	}
+
+	return u.userTokens, nil
+}
+
+// updateSettings changes the settings of the user with fn and returns them.
+func (d *database) updateSettings(profileURL string, fn func(settings *userSettings)) (userSettings, error) {
+	u, err := d.updateUser(profileURL, func(u *user) {
+		fn(&u.userSettings)
+		u.startImports(time.Now())
+	})
+	if err != nil {
+		return userSettings{}, err
+	}
+
+	return u.userSettings, nil
+}
+
+// setBulkImport starts, or cancels if b is nil, the bulk import of the user.
+func (d *database) setBulkImport(profileURL string, b *bulkImport) error {
+	_, err := d.updateUser(profileURL, func(u *user) {
+		u.BulkImport = b
 	})
+	return err
+}
+
+// setNextRunAt sets when the user is imported next.
+func (d *database) setNextRunAt(profileURL string, t time.Time) error {
+	_, err := d.updateSettings(profileURL, func(settings *userSettings) {
+		settings.NextRunAt = t
+	})
+	return err
+}
+
+func putUser(b *bolt.Bucket, u *user) error {
+	encoded, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+
+	return b.Put([]byte(u.ProfileURL), encoded)
 }
 
 func (d *database) close() error {
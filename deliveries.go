@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+type deliveryStatus string
+
+const (
+	deliveryDelivered deliveryStatus = "delivered"
+	deliveryFailed    deliveryStatus = "failed"
+	deliveryDeleted   deliveryStatus = "deleted"
+	deliveryDead      deliveryStatus = "dead"
+	deliverySkipped   deliveryStatus = "skipped"
+	deliveryHeld      deliveryStatus = "held"
+)
+
+// Kinds of deliveries, one per Trakt stream we import.
+const (
+	historyKind   = "history"
+	ratingsKind   = "ratings"
+	watchlistKind = "watchlist"
+	commentsKind  = "comments"
+	watchingKind  = "watching"
+)
+
+var deliveryKinds = []string{historyKind, ratingsKind, watchlistKind, commentsKind, watchingKind}
+
+// delivery records what happened to a single item we imported from Trakt:
+// whether it was posted, where it was posted to, and the last error.
+type delivery struct {
+	Key       string
+	Kind      string
+	Title     string
+	Date      time.Time
+	Status    deliveryStatus
+	Location  string
+	Error     string
+	Attempts  int
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// Aggregated is set when the post also includes other items, e.g., a binge.
+	Aggregated bool `json:",omitempty"`
+	// RetryAt is when a failed item may be sent again.
+	RetryAt time.Time
+	// Reason says why the item was skipped, if it was skipped by a rule.
+	Reason    string              `json:",omitempty"`
+	Item      *traktHistoryItem   `json:",omitempty"`
+	Rating    *traktRating        `json:",omitempty"`
+	Watchlist *traktWatchlistItem `json:",omitempty"`
+	Comment   *traktCommentItem   `json:",omitempty"`
+}
+
+func historyKey(id int64) string {
+	return strconv.FormatInt(id, 10)
+}
+
+func newHistoryDelivery(item traktHistoryItem) *delivery {
+	return &delivery{
+		Key:   historyKey(item.ID),
+		Kind:  historyKind,
+		Title: item.title(),
+		Date:  item.WatchedAt,
+		Item:  &item,
+	}
+}
+
+// deliveriesBucket returns the bucket holding the deliveries of a certain kind
+// for a certain user. Buckets are nested as deliveries > profile URL > kind.
+func deliveriesBucket(tx *bolt.Tx, profileURL, kind string) (*bolt.Bucket, error) {
+	b, err := tx.CreateBucketIfNotExists([]byte("deliveries"))
+	if err != nil {
+		return nil, err
+	}
+
+	b, err = b.CreateBucketIfNotExists([]byte(profileURL))
+	if err != nil {
+		return nil, err
+	}
+
+	return b.CreateBucketIfNotExists([]byte(kind))
+}
+
+// getDelivery returns the delivery with the given key, or nil if there is none.
+func (d *database) getDelivery(profileURL, kind, key string) (*delivery, error) {
+	var dl *delivery
+
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		b, err := deliveriesBucket(tx, profileURL, kind)
+		if err != nil {
+			return err
+		}
+
+		v := b.Get([]byte(key))
+		if v == nil {
+			return nil
+		}
+
+		dl = &delivery{}
+		return json.Unmarshal(v, dl)
+	})
+
+	return dl, err
+}
+
+func (d *database) getDeliveries(profileURL, kind string) ([]*delivery, error) {
+	deliveries := []*delivery{}
+
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		b, err := deliveriesBucket(tx, profileURL, kind)
+		if err != nil {
+			return err
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			dl := &delivery{}
+			err := json.Unmarshal(v, dl)
+			if err != nil {
+				return err
+			}
+			deliveries = append(deliveries, dl)
+			return nil
+		})
+	})
+
+	return deliveries, err
+}
+
+// getRecentDeliveries returns a page of deliveries, most recent first, as well
+// as the total number of deliveries. If status is not empty, only deliveries with
+// that status are returned.
+func (d *database) getRecentDeliveries(profileURL, kind string, status deliveryStatus, page, perPage int) ([]*delivery, int, error) {
+	all, err := d.getDeliveries(profileURL, kind)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	deliveries := []*delivery{}
+	for _, dl := range all {
+		if status == "" || dl.Status == status {
+			deliveries = append(deliveries, dl)
+		}
+	}
+
+	sort.SliceStable(deliveries, func(i, j int) bool {
+		return deliveries[i].Date.After(deliveries[j].Date)
+	})
+
+	start := (page - 1) * perPage
+	if start > len(deliveries) {
+		start = len(deliveries)
+	}
+
+	end := start + perPage
+	if end > len(deliveries) {
+		end = len(deliveries)
+	}
+
+	return deliveries[start:end], len(deliveries), nil
+}
+
+func (d *database) saveDelivery(profileURL string, dl *delivery) error {
+	dl.UpdatedAt = time.Now()
+	if dl.CreatedAt.IsZero() {
+		dl.CreatedAt = dl.UpdatedAt
+	}
+
+	return d.db.Update(func(tx *bolt.Tx) error {
+		b, err := deliveriesBucket(tx, profileURL, dl.Kind)
+		if err != nil {
+			return err
+		}
+
+		encoded, err := json.Marshal(dl)
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte(dl.Key), encoded)
+	})
+}
+
+func (d *database) deleteDeliveries(profileURL, kind string) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("deliveries"))
+		if err != nil {
+			return err
+		}
+
+		b = b.Bucket([]byte(profileURL))
+		if b == nil || b.Bucket([]byte(kind)) == nil {
+			return nil
+		}
+
+		return b.DeleteBucket([]byte(kind))
+	})
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Ways of encoding Micropub requests.
+const (
+	modeJSON      = "json"
+	modeForm      = "form"
+	modeMultipart = "multipart"
+)
+
+var micropubModes = []string{"", modeJSON, modeForm, modeMultipart}
+
+// micropubModeFor returns how to encode the request for the user. Updates can
+// only be sent as JSON.
+func micropubModeFor(user *user, body map[string]interface{}) string {
+	if body["action"] == "update" {
+		return modeJSON
+	}
+
+	if user.MicropubMode != "" {
+		return user.MicropubMode
+	}
+
+	if user.DetectedMicropubMode != "" {
+		return user.DetectedMicropubMode
+	}
+
+	return modeJSON
+}
+
+// isJSONRefused returns whether the endpoint says it does not support JSON
+// requests: either with a 415, or with a 400 that says the media, or content,
+// type is unsupported, e.g., {"error":"unsupported_media_type"}. Other 400s
+// are about the post itself, which forms would not fix.
+func isJSONRefused(err error) bool {
+	var mErr *micropubError
+	if !errors.As(err, &mErr) {
+		return false
+	}
+
+	if mErr.StatusCode == http.StatusUnsupportedMediaType {
+		return true
+	}
+
+	body := strings.NewReplacer("_", " ", "-", " ").Replace(strings.ToLower(mErr.Body))
+	return mErr.StatusCode == http.StatusBadRequest &&
+		(strings.Contains(body, "unsupported media type") || strings.Contains(body, "unsupported content type"))
+}
+
+// encodeMicropub encodes the request according to mode and returns it with its
+// content type.
+func encodeMicropub(body map[string]interface{}, mode string) ([]byte, string, error) {
+	if mode == modeJSON {
+		data, err := json.Marshal(body)
+		return data, "application/json", err
+	}
+
+	values, err := flattenMicropub(body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if mode == modeForm {
+		return []byte(values.Encode()), "application/x-www-form-urlencoded", nil
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		for _, value := range values[key] {
+			err = mw.WriteField(key, value)
+			if err != nil {
+				return nil, "", err
+			}
+		}
+	}
+
+	err = mw.Close()
+	return buf.Bytes(), mw.FormDataContentType(), err
+}
+
+// flattenMicropub converts a JSON Micropub request into form fields. Form
+// encoding cannot represent nested objects: h-cites are replaced by their URL,
+// and other objects, such as the Trakt IDs, are dropped.
+func flattenMicropub(body map[string]interface{}) (url.Values, error) {
+	// Going through JSON leaves us with only a few types to handle.
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	var request struct {
+		Type       []string                 `json:"type"`
+		Properties map[string][]interface{} `json:"properties"`
+		Action     string                   `json:"action"`
+		URL        string                   `json:"url"`
+	}
+
+	err = json.Unmarshal(data, &request)
+	if err != nil {
+		return nil, err
+	}
+
+	values := url.Values{}
+
+	if request.Action != "" {
+		values.Set("action", request.Action)
+		values.Set("url", request.URL)
+		return values, nil
+	}
+
+	if len(request.Type) > 0 {
+		values.Set("h", strings.TrimPrefix(request.Type[0], "h-"))
+	}
+
+	for key, property := range request.Properties {
+		flat := []string{}
+		for _, value := range property {
+			if s, ok := flattenValue(value); ok {
+				flat = append(flat, s)
+			}
+		}
+
+		if len(flat) == 1 {
+			values[key] = flat
+		} else if len(flat) > 1 {
+			values[key+"[]"] = flat
+		}
+	}
+
+	return values, nil
+}
+
+func flattenValue(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	case map[string]interface{}:
+		// An h-cite, or another microformat: use its URL.
+		properties, _ := v["properties"].(map[string]interface{})
+		urls, _ := properties["url"].([]interface{})
+		if len(urls) > 0 {
+			if u, ok := urls[0].(string); ok {
+				return u, true
+			}
+		}
+	}
+
+	return "", false
+}
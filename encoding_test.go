@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFlattenMicropub(t *testing.T) {
+	body := map[string]interface{}{
+		"type": []string{"h-entry"},
+		"properties": map[string]interface{}{
+			"summary":  []interface{}{"Watched Fake Movie"},
+			"category": []interface{}{"movies", "drama"},
+			"rating":   []interface{}{8},
+			"watch-of": []interface{}{map[string]interface{}{
+				"type": []string{"h-cite"},
+				"properties": map[string]interface{}{
+					"name": []interface{}{"Fake Movie"},
+					"url":  []interface{}{"https://trakt.tv/movies/fake-movie"},
+				},
+			}},
+			"trakt": []interface{}{map[string]interface{}{"id": 1}},
+		},
+	}
+
+	values, err := flattenMicropub(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string][]string{
+		"h":          {"entry"},
+		"summary":    {"Watched Fake Movie"},
+		"category[]": {"movies", "drama"},
+		"rating":     {"8"},
+		"watch-of":   {"https://trakt.tv/movies/fake-movie"},
+	}
+
+	if !reflect.DeepEqual(map[string][]string(values), expected) {
+		t.Errorf("expected %v, got %v", expected, values)
+	}
+}
+
+func TestFlattenMicropubAction(t *testing.T) {
+	values, err := flattenMicropub(map[string]interface{}{
+		"action": "delete",
+		"url":    "https://me.example/posts/1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if values.Encode() != "action=delete&url=https%3A%2F%2Fme.example%2Fposts%2F1" {
+		t.Errorf("unexpected form: %s", values.Encode())
+	}
+}
+
+func TestEncodeMicropubMultipart(t *testing.T) {
+	data, contentType, err := encodeMicropub(map[string]interface{}{
+		"type":       []string{"h-entry"},
+		"properties": map[string]interface{}{"summary": []interface{}{"Hello"}},
+	}, modeMultipart)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(contentType, "multipart/form-data; boundary=") {
+		t.Errorf("unexpected content type %s", contentType)
+	}
+
+	if !strings.Contains(string(data), `name="summary"`) || !strings.Contains(string(data), "Hello") {
+		t.Errorf("expected the summary in the body, got %s", data)
+	}
+}
+
+func TestIsJSONRefused(t *testing.T) {
+	tests := []struct {
+		status   int
+		body     string
+		expected bool
+	}{
+		{http.StatusUnsupportedMediaType, "", true},
+		{http.StatusBadRequest, "Unsupported Content-Type", true},
+		{http.StatusBadRequest, "unsupported media type: application/json", true},
+		{http.StatusBadRequest, `{"error":"unsupported_media_type"}`, true},
+		{http.StatusBadRequest, `{"error":"invalid_request","error_description":"missing summary"}`, false},
+		{http.StatusBadRequest, "could not parse JSON", false},
+		{http.StatusBadRequest, "missing property: summary", false},
+		{http.StatusInternalServerError, "json", false},
+	}
+
+	for _, test := range tests {
+		err := &micropubError{StatusCode: test.status, Body: test.body}
+		if got := isJSONRefused(err); got != test.expected {
+			t.Errorf("%d %q: expected %v, got %v", test.status, test.body, test.expected, got)
+		}
+	}
+}
+
+func TestPostMicropubFallsBackToForms(t *testing.T) {
+	a, mp, u := newTestApp(t, nil)
+	mp.failNext(1, http.StatusUnsupportedMediaType, "")
+
+	body := map[string]interface{}{
+		"type":       []string{"h-entry"},
+		"properties": map[string]interface{}{"summary": []interface{}{"Hello"}},
+	}
+
+	_, err := a.postMicropub(u, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, forms := mp.received()
+	if len(forms) != 1 || forms[0].Get("summary") != "Hello" {
+		t.Fatalf("expected the post to be sent as a form, got %v", forms)
+	}
+
+	stored, err := a.db.get(u.ProfileURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stored.DetectedMicropubMode != modeForm {
+		t.Errorf("expected forms to be remembered, got %q", stored.DetectedMicropubMode)
+	}
+}
+
+func TestPostMicropubKeepsJSONOnOtherErrors(t *testing.T) {
+	a, mp, u := newTestApp(t, nil)
+	mp.failNext(1, http.StatusBadRequest, "missing property: summary")
+
+	_, err := a.postMicropub(u, map[string]interface{}{"type": []string{"h-entry"}})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	_, forms := mp.received()
+	if len(forms) != 0 || u.DetectedMicropubMode != "" {
+		t.Error("expected forms not to be tried")
+	}
+
+	// Bodies of JSON APIs mention JSON without refusing it.
+	mp.failNext(1, http.StatusBadRequest, `{"error":"invalid_request","error_description":"invalid JSON property"}`)
+
+	_, err = a.postMicropub(u, map[string]interface{}{"type": []string{"h-entry"}})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	_, forms = mp.received()
+	if len(forms) != 0 || u.DetectedMicropubMode != "" {
+		t.Error("expected forms not to be tried")
+	}
+}
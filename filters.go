@@ -0,0 +1,274 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// filterRule matches watches that meet all of its conditions. Empty conditions
+// match everything.
+type filterRule struct {
+	Exclude bool
+	// Type is either movie or episode.
+	Type string
+	// Show is the slug or the Trakt ID of a show.
+	Show  string
+	Genre string
+	// From and To limit the time of day of the watch, as HH:MM in the user's
+	// timezone. If To is before From, the range goes through midnight.
+	From       string
+	To         string
+	MinRuntime int
+}
+
+func (r filterRule) String() string {
+	conditions := []string{"movies and episodes"}
+
+	if r.Type != "" {
+		conditions[0] = r.Type + "s"
+	}
+
+	if r.Show != "" {
+		conditions = append(conditions, "of "+r.Show)
+	}
+
+	if r.Genre != "" {
+		conditions = append(conditions, "in "+r.Genre)
+	}
+
+	if r.From != "" || r.To != "" {
+		conditions = append(conditions, "watched between "+orDefault(r.From, "00:00")+" and "+orDefault(r.To, "24:00"))
+	}
+
+	if r.MinRuntime > 0 {
+		conditions = append(conditions, fmt.Sprintf("at least %d minutes long", r.MinRuntime))
+	}
+
+	action := "include"
+	if r.Exclude {
+		action = "exclude"
+	}
+
+	return action + " " + strings.Join(conditions, " ")
+}
+
+// validate checks the rule, returning an error describing the first problem.
+func (r filterRule) validate() error {
+	if r.Type != "" && r.Type != "movie" && r.Type != "episode" {
+		return errors.New("invalid type " + r.Type)
+	}
+
+	if r.Show != "" && r.Type == "movie" {
+		return errors.New("movies do not have shows")
+	}
+
+	for _, t := range []string{r.From, r.To} {
+		if _, err := minuteOfDay(t); t != "" && err != nil {
+			return errors.New("invalid time " + t + ", use HH:MM")
+		}
+	}
+
+	if r.MinRuntime < 0 {
+		return errors.New("minimum runtime cannot be negative")
+	}
+
+	return nil
+}
+
+func minuteOfDay(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, err
+	}
+
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func orDefault(value, def string) string {
+	if value == "" {
+		return def
+	}
+
+	return value
+}
+
+// matches returns whether the item meets all the conditions of the rule. The
+// metadata is only fetched if the rule needs it.
+func (r filterRule) matches(a *app, user *user, item traktHistoryItem, loc *time.Location) (bool, error) {
+	if r.Type != "" && item.Type != r.Type {
+		return false, nil
+	}
+
+	if r.Show != "" {
+		if item.Type != "episode" || (item.Show.IDs.Slug != r.Show && strconv.Itoa(item.Show.IDs.Trakt) != r.Show) {
+			return false, nil
+		}
+	}
+
+	if r.From != "" || r.To != "" {
+		from, _ := minuteOfDay(orDefault(r.From, "00:00"))
+		to := 24 * 60
+		if r.To != "" {
+			to, _ = minuteOfDay(r.To)
+		}
+
+		watchedAt := item.WatchedAt.In(loc)
+		minute := watchedAt.Hour()*60 + watchedAt.Minute()
+
+		if from <= to && (minute < from || minute >= to) {
+			return false, nil
+		}
+
+		if from > to && minute < from && minute >= to {
+			return false, nil
+		}
+	}
+
+	if r.Genre == "" && r.MinRuntime == 0 {
+		return true, nil
+	}
+
+	genres, runtime, err := a.genresAndRuntime(user, item)
+	if err != nil {
+		return false, err
+	}
+
+	if r.Genre != "" {
+		found := false
+		for _, genre := range genres {
+			found = found || strings.EqualFold(genre, r.Genre)
+		}
+
+		if !found {
+			return false, nil
+		}
+	}
+
+	return runtime >= r.MinRuntime, nil
+}
+
+// genresAndRuntime returns the genres and the runtime, in minutes, of what was
+// watched. Episodes have the genres of their show, and its runtime if they do
+// not have one.
+func (a *app) genresAndRuntime(user *user, item traktHistoryItem) ([]string, int, error) {
+	if item.Type == "movie" {
+		m, err := a.movieMetadata(user, item.Movie)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		return m.Genres, m.Runtime, nil
+	}
+
+	show, err := a.showMetadata(user, item.Show)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	episode, err := a.episodeMetadata(user, item.Show, item.Episode)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if episode.Runtime > 0 {
+		return show.Genres, episode.Runtime, nil
+	}
+
+	return show.Genres, show.Runtime, nil
+}
+
+// filterReason returns why the user's rules keep the item from being posted, or
+// an empty string if it should be posted. Exclude rules win over include rules
+// and, if there are include rules, the item must match one of them.
+func (a *app) filterReason(user *user, item traktHistoryItem) (string, error) {
+	if len(user.Filters) == 0 {
+		return "", nil
+	}
+
+	loc, err := time.LoadLocation(user.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+
+	hasInclude := false
+	included := false
+
+	for i, rule := range user.Filters {
+		if !rule.Exclude {
+			hasInclude = true
+			if included {
+				continue
+			}
+		}
+
+		matches, err := rule.matches(a, user, item, loc)
+		if isTraktNotFound(err) {
+			// What was watched is gone from Trakt, so the rules that need its
+			// metadata can never match it.
+			log.Printf("%s - rule %d does not match %d: %v\n", user.ProfileURL, i+1, item.ID, err)
+			matches, err = false, nil
+		}
+		if err != nil {
+			return "", err
+		}
+
+		if !matches {
+			continue
+		}
+
+		if rule.Exclude {
+			return fmt.Sprintf("skipped by rule %d: %s", i+1, rule), nil
+		}
+
+		included = true
+	}
+
+	if hasInclude && !included {
+		return "skipped by rule: not included by any rule", nil
+	}
+
+	return "", nil
+}
+
+// skipFiltered records the item as skipped if the user's rules keep it from
+// being posted, unless it was handled before. It returns whether it was
+// skipped. An error is only returned if the rules should be evaluated later,
+// i.e., if the metadata could not be fetched for now.
+func (a *app) skipFiltered(user *user, item traktHistoryItem) (bool, error) {
+	if len(user.Filters) == 0 {
+		return false, nil
+	}
+
+	d, err := a.db.getDelivery(user.ProfileURL, historyKind, historyKey(item.ID))
+	if err != nil {
+		return false, err
+	}
+
+	if d != nil && d.Status != deliveryFailed {
+		return false, nil
+	}
+
+	reason, err := a.filterReason(user, item)
+	if err != nil {
+		a.backoff(user)
+		return false, err
+	}
+
+	if reason == "" {
+		return false, nil
+	}
+
+	if d == nil {
+		d = newHistoryDelivery(item)
+	}
+
+	log.Printf("%s - %s %s\n", user.ProfileURL, d.Key, reason)
+	d.Status = deliverySkipped
+	d.Reason = reason
+	d.Error = ""
+	return true, a.db.saveDelivery(user.ProfileURL, d)
+}
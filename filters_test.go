@@ -0,0 +1,211 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFilterRuleValidate(t *testing.T) {
+	tests := []struct {
+		rule  filterRule
+		valid bool
+	}{
+		{filterRule{}, true},
+		{filterRule{Type: "episode", Show: "fake-show", From: "22:00", To: "02:00"}, true},
+		{filterRule{Type: "show"}, false},
+		{filterRule{Type: "movie", Show: "fake-show"}, false},
+		{filterRule{From: "25:00"}, false},
+		{filterRule{MinRuntime: -1}, false},
+	}
+
+	for _, test := range tests {
+		if err := test.rule.validate(); (err == nil) != test.valid {
+			t.Errorf("%s: expected valid to be %v, got %v", test.rule, test.valid, err)
+		}
+	}
+}
+
+func TestFilterRuleTimeOfDay(t *testing.T) {
+	watchedAt := func(hour, minute int) traktHistoryItem {
+		return traktHistoryItem{
+			Type:      "movie",
+			WatchedAt: time.Date(2021, 3, 4, hour, minute, 0, 0, time.UTC),
+		}
+	}
+
+	tests := []struct {
+		rule     filterRule
+		item     traktHistoryItem
+		expected bool
+	}{
+		{filterRule{From: "09:00", To: "17:00"}, watchedAt(9, 0), true},
+		{filterRule{From: "09:00", To: "17:00"}, watchedAt(17, 0), false},
+		{filterRule{From: "09:00"}, watchedAt(23, 59), true},
+		{filterRule{To: "09:00"}, watchedAt(9, 30), false},
+		// Through midnight.
+		{filterRule{From: "22:00", To: "02:00"}, watchedAt(23, 0), true},
+		{filterRule{From: "22:00", To: "02:00"}, watchedAt(1, 59), true},
+		{filterRule{From: "22:00", To: "02:00"}, watchedAt(2, 0), false},
+		{filterRule{From: "22:00", To: "02:00"}, watchedAt(12, 0), false},
+	}
+
+	for _, test := range tests {
+		matches, err := test.rule.matches(&app{}, &user{}, test.item, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if matches != test.expected {
+			t.Errorf("%s at %s: expected %v, got %v", test.rule, test.item.WatchedAt.Format("15:04"), test.expected, matches)
+		}
+	}
+}
+
+func TestFilterRuleTimezone(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	// 03:00 UTC is 22:00 the day before in New York.
+	item := traktHistoryItem{Type: "movie", WatchedAt: time.Date(2021, 3, 4, 3, 0, 0, 0, time.UTC)}
+	rule := filterRule{From: "21:00", To: "23:00"}
+
+	matches, err := rule.matches(&app{}, &user{}, item, loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !matches {
+		t.Error("expected the time of day to be in the user's timezone")
+	}
+}
+
+func TestFilterReason(t *testing.T) {
+	episode := traktHistoryItem{
+		Type: "episode",
+		Show: traktShow{IDs: traktIDs{Trakt: 1000, Slug: "fake-show"}},
+	}
+	movie := traktHistoryItem{Type: "movie"}
+
+	tests := []struct {
+		filters []filterRule
+		item    traktHistoryItem
+		skipped string
+	}{
+		{nil, movie, ""},
+		{[]filterRule{{Exclude: true, Type: "movie"}}, movie, "skipped by rule 1: exclude movies"},
+		{[]filterRule{{Exclude: true, Type: "movie"}}, episode, ""},
+		{[]filterRule{{Type: "episode", Show: "1000"}}, movie, "skipped by rule: not included by any rule"},
+		{[]filterRule{{Type: "episode", Show: "1000"}}, episode, ""},
+		// Exclude rules win over include rules.
+		{[]filterRule{{Type: "episode"}, {Exclude: true, Show: "fake-show"}}, episode, "skipped by rule 2"},
+	}
+
+	for _, test := range tests {
+		u := &user{}
+		u.Filters = test.filters
+
+		reason, err := (&app{}).filterReason(u, test.item)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if (test.skipped == "") != (reason == "") || !strings.HasPrefix(reason, test.skipped) {
+			t.Errorf("%v on %s: expected %q, got %q", test.filters, test.item.Type, test.skipped, reason)
+		}
+	}
+}
+
+func TestFilterReasonMetadata(t *testing.T) {
+	a, _, u := newTestApp(t, func(s *userSettings) {
+		s.Filters = []filterRule{{Genre: "Comedy"}, {Exclude: true, MinRuntime: 60}}
+	})
+
+	// Episodes of the fake show are comedies, and the movies are dramas.
+	episode := historyItem(t, a, 4)
+	movie := historyItem(t, a, 1)
+
+	reason, err := a.filterReason(u, episode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reason != "" {
+		t.Errorf("expected the episode to be posted, got %q", reason)
+	}
+
+	reason, err = a.filterReason(u, movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reason == "" {
+		t.Error("expected the movie to be skipped")
+	}
+}
+
+func TestImportSkipsFiltered(t *testing.T) {
+	a, mp, u := newTestApp(t, func(s *userSettings) {
+		s.Filters = []filterRule{{Exclude: true, Type: "episode"}}
+	})
+
+	a.importTrakt(u, false, false, 0)
+
+	posts, _ := mp.received()
+	if len(posts) != 0 {
+		t.Errorf("expected nothing to be posted, got %d posts", len(posts))
+	}
+
+	d := getHistoryDelivery(t, a, u, 4)
+	if d == nil || d.Status != deliverySkipped || d.Reason == "" {
+		t.Errorf("expected the episode to be recorded as skipped, got %+v", d)
+	}
+}
+
+func TestSkipFilteredGoneFromTrakt(t *testing.T) {
+	a, _, u := newTestApp(t, func(s *userSettings) {
+		s.Filters = []filterRule{{Genre: "Comedy"}}
+	})
+
+	// The fake Trakt only knows about what is in the history.
+	gone := traktHistoryItem{
+		ID:        99,
+		Type:      "movie",
+		Action:    "watch",
+		WatchedAt: time.Now().Add(-time.Hour).UTC().Truncate(time.Second),
+		Movie:     traktMovie{Title: "Gone Movie", Year: 2000, IDs: traktIDs{Trakt: 9999}},
+	}
+
+	skipped, err := a.skipFiltered(u, gone)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !skipped {
+		t.Error("expected the movie not to be included")
+	}
+
+	d := getHistoryDelivery(t, a, u, 99)
+	if d == nil || d.Status != deliverySkipped {
+		t.Errorf("expected the movie to be recorded as skipped, got %+v", d)
+	}
+
+	if u.FailureCount != 0 || !u.RetryAt.IsZero() {
+		t.Errorf("expected no backoff, got %d failures until %s", u.FailureCount, u.RetryAt)
+	}
+
+	// Exclude rules do not match it either.
+	u.Filters = []filterRule{{Exclude: true, Genre: "Comedy"}}
+	gone.ID = 100
+
+	skipped, err = a.skipFiltered(u, gone)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if skipped {
+		t.Error("expected the movie to be posted")
+	}
+}
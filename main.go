@@ -38,6 +38,8 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	go app.scheduleImports(ctx)
+	go app.pollWatching(ctx)
+	go app.pollBulkImports(ctx)
 
 	quit := make(chan os.Signal, 1)
 
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"path"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// maxPhotoSize is the largest photo we are willing to download and upload.
+const maxPhotoSize = 10 << 20
+
+var errNoMediaEndpoint = errors.New("micropub endpoint has no media endpoint")
+
+// mediaBucket returns the bucket holding the URLs of the media uploaded for a
+// certain user, keyed by the Trakt type and ID of what is in them.
+func mediaBucket(tx *bolt.Tx, profileURL string) (*bolt.Bucket, error) {
+	b, err := tx.CreateBucketIfNotExists([]byte("media"))
+	if err != nil {
+		return nil, err
+	}
+
+	return b.CreateBucketIfNotExists([]byte(profileURL))
+}
+
+func (d *database) getMedia(profileURL, key string) (string, error) {
+	var location string
+
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		b, err := mediaBucket(tx, profileURL)
+		if err != nil {
+			return err
+		}
+
+		location = string(b.Get([]byte(key)))
+		return nil
+	})
+
+	return location, err
+}
+
+func (d *database) saveMedia(profileURL, key, location string) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		b, err := mediaBucket(tx, profileURL)
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte(key), []byte(location))
+	})
+}
+
+// mediaEndpoint returns the user's media endpoint, discovering it if we do not
+// know the configuration of their Micropub endpoint yet.
+func (a *app) mediaEndpoint(user *user) (string, error) {
+	if user.MicropubConfig == nil {
+		err := a.refreshMicropubConfig(user)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if user.MicropubConfig.MediaEndpoint == "" {
+		return "", errNoMediaEndpoint
+	}
+
+	return user.MicropubConfig.MediaEndpoint, nil
+}
+
+// uploadWatchPhoto uploads the poster, or still, of what was watched to the
+// user's media endpoint and uses it as the photo of the post. Photos are only
+// uploaded once. If anything fails, the post is sent without it.
+func (a *app) uploadWatchPhoto(user *user, item traktHistoryItem, mf2 map[string]interface{}) {
+	var key, photo string
+
+	switch item.Type {
+	case "movie":
+		key = "movie:" + strconv.Itoa(item.Movie.IDs.Trakt)
+		if m, err := a.movieMetadata(user, item.Movie); err == nil {
+			photo = m.Photo
+		}
+	case "episode":
+		key = "episode:" + strconv.Itoa(item.Episode.IDs.Trakt)
+		if m, err := a.episodeMetadata(user, item.Show, item.Episode); err == nil {
+			photo = m.Photo
+		}
+		if photo == "" {
+			key = "show:" + strconv.Itoa(item.Show.IDs.Trakt)
+			if m, err := a.showMetadata(user, item.Show); err == nil {
+				photo = m.Photo
+			}
+		}
+	}
+
+	location, err := a.db.getMedia(user.ProfileURL, key)
+	if err != nil {
+		log.Printf("%s - could not get media: %v\n", user.ProfileURL, err)
+		return
+	}
+
+	if location == "" {
+		if photo == "" {
+			return
+		}
+
+		location, err = a.uploadPhoto(user, photo)
+		if err != nil {
+			log.Printf("%s - could not upload %s: %v\n", user.ProfileURL, photo, err)
+			return
+		}
+
+		err = a.db.saveMedia(user.ProfileURL, key, location)
+		if err != nil {
+			log.Printf("%s - could not save media: %v\n", user.ProfileURL, err)
+		}
+	}
+
+	properties := mf2["properties"].(map[string]interface{})
+	properties["photo"] = []string{location}
+
+	if watch := citeProperties(properties, "watch-of"); watch != nil {
+		watch["photo"] = []string{location}
+	}
+}
+
+// uploadPhoto downloads the photo and uploads it to the user's media endpoint,
+// returning its new URL.
+func (a *app) uploadPhoto(user *user, photo string) (string, error) {
+	endpoint, err := a.mediaEndpoint(user)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*2)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", photo, nil)
+	if err != nil {
+		return "", err
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", errors.New("could not download photo: status " + strconv.Itoa(res.StatusCode))
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, maxPhotoSize+1))
+	if err != nil {
+		return "", err
+	}
+
+	if len(data) > maxPhotoSize {
+		return "", errors.New("photo is too large")
+	}
+
+	contentType := res.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="file"; filename="`+path.Base(req.URL.Path)+`"`)
+	header.Set("Content-Type", contentType)
+
+	part, err := mw.CreatePart(header)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = part.Write(data)
+	if err != nil {
+		return "", err
+	}
+
+	err = mw.Close()
+	if err != nil {
+		return "", err
+	}
+
+	httpClient, err := a.getMicropubClient(user)
+	if err != nil {
+		return "", err
+	}
+
+	req, err = http.NewRequestWithContext(ctx, "POST", endpoint, &body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		bodyBytes, _ := ioutil.ReadAll(resp.Body)
+		err = &micropubError{
+			ProfileURL: user.ProfileURL,
+			StatusCode: resp.StatusCode,
+			Body:       string(bodyBytes),
+		}
+		a.checkMicropubUnauthorized(user, err)
+		return "", err
+	}
+
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return "", errors.New("media endpoint did not return a location")
+	}
+
+	return location, nil
+}
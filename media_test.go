@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestUploadPhotos(t *testing.T) {
+	a, mp, u := newTestApp(t, func(s *userSettings) {
+		s.UploadPhotos = true
+	})
+	useFakeTMDb(a)
+	mp.setConfig(&micropubConfig{MediaEndpoint: u.MicropubEndpoint + "/media"})
+
+	a.importCycle(u)
+
+	posts, _ := mp.received()
+	if len(posts) != 5 {
+		t.Fatalf("expected 5 posts, got %d", len(posts))
+	}
+
+	media := mp.uploaded()
+	if len(media) != 5 {
+		t.Fatalf("expected the still of each episode to be uploaded, got %d uploads", len(media))
+	}
+
+	for i, data := range media {
+		if !bytes.Equal(data, fakeImage) {
+			t.Errorf("upload %d: expected the image from tmdb, got %d bytes", i+1, len(data))
+		}
+	}
+
+	for i, post := range posts {
+		location := fmt.Sprintf("https://me.example/media/%d", i+1)
+		properties, _ := post["properties"].(map[string]interface{})
+		expectProperty(t, properties, "photo", location)
+		expectProperty(t, citeProperties(properties, "watch-of"), "photo", location)
+	}
+
+	if mp.configs != 1 {
+		t.Errorf("expected the media endpoint to be discovered once, got %d queries", mp.configs)
+	}
+
+	// Photos are only uploaded once.
+	item := historyItem(t, a, 4)
+	micro, err := traktToMicroformats(item, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := a.db.get(u.ProfileURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.uploadWatchPhoto(stored, item, micro)
+
+	if len(mp.uploaded()) != 5 {
+		t.Errorf("expected the photo not to be uploaded again, got %d uploads", len(mp.uploaded()))
+	}
+
+	expectMicroPhoto(t, micro, "https://me.example/media/1")
+}
+
+func TestUploadPhotosWithoutMediaEndpoint(t *testing.T) {
+	a, mp, u := newTestApp(t, func(s *userSettings) {
+		s.UploadPhotos = true
+	})
+	useFakeTMDb(a)
+
+	a.importCycle(u)
+
+	posts, _ := mp.received()
+	if len(posts) != 5 {
+		t.Fatalf("expected the posts to be sent without photos, got %d posts", len(posts))
+	}
+
+	properties, _ := posts[0]["properties"].(map[string]interface{})
+	if _, ok := properties["photo"]; ok {
+		t.Errorf("expected no photo, got %v", properties["photo"])
+	}
+
+	if len(mp.uploaded()) != 0 {
+		t.Errorf("expected nothing to be uploaded, got %d uploads", len(mp.uploaded()))
+	}
+}
+
+// expectMicroPhoto checks the photo of a post that was not sent yet.
+func expectMicroPhoto(t *testing.T, mf2 map[string]interface{}, expected string) {
+	t.Helper()
+
+	properties := mf2["properties"].(map[string]interface{})
+	if photo, _ := properties["photo"].([]string); len(photo) != 1 || photo[0] != expected {
+		t.Errorf("expected the photo to be %s, got %v", expected, properties["photo"])
+	}
+}
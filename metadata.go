@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// metadataTTL is for how long the metadata of movies, shows and episodes is
+// cached before being fetched again.
+const metadataTTL = time.Hour * 24 * 30
+
+// mediaMetadata is what we know about a movie, show or episode besides what
+// comes in the history.
+type mediaMetadata struct {
+	Overview      string
+	Runtime       int
+	Genres        []string
+	Certification string
+	Released      time.Time
+	Photo         string
+	FetchedAt     time.Time
+}
+
+// traktExtended holds the fields Trakt adds to movies, shows and episodes with
+// extended=full.
+type traktExtended struct {
+	Overview      string    `json:"overview"`
+	Runtime       int       `json:"runtime"`
+	Genres        []string  `json:"genres"`
+	Certification string    `json:"certification"`
+	Released      string    `json:"released"`
+	FirstAired    time.Time `json:"first_aired"`
+}
+
+func (e traktExtended) metadata() *mediaMetadata {
+	m := &mediaMetadata{
+		Overview:      e.Overview,
+		Runtime:       e.Runtime,
+		Genres:        e.Genres,
+		Certification: e.Certification,
+		Released:      e.FirstAired,
+	}
+
+	if released, err := time.Parse("2006-01-02", e.Released); err == nil {
+		m.Released = released
+	}
+
+	return m
+}
+
+func (d *database) getMetadata(key string) (*mediaMetadata, error) {
+	var m *mediaMetadata
+
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("metadata"))
+		if err != nil {
+			return err
+		}
+
+		v := b.Get([]byte(key))
+		if v == nil {
+			return nil
+		}
+
+		m = &mediaMetadata{}
+		return json.Unmarshal(v, m)
+	})
+
+	return m, err
+}
+
+func (d *database) saveMetadata(key string, m *mediaMetadata) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("metadata"))
+		if err != nil {
+			return err
+		}
+
+		encoded, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte(key), encoded)
+	})
+}
+
+// getMetadata returns the cached metadata under key, calling fetch if there is
+// none or it is too old. Old metadata is still used if fetching fails.
+func (a *app) getMetadata(key string, fetch func() (*mediaMetadata, error)) (*mediaMetadata, error) {
+	cached, err := a.db.getMetadata(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if cached != nil && time.Since(cached.FetchedAt) < metadataTTL {
+		return cached, nil
+	}
+
+	m, err := fetch()
+	if err != nil {
+		if cached != nil {
+			return cached, nil
+		}
+		return nil, err
+	}
+
+	m.FetchedAt = time.Now()
+	err = a.db.saveMetadata(key, m)
+	return m, err
+}
+
+func (a *app) movieMetadata(user *user, movie traktMovie) (*mediaMetadata, error) {
+	return a.getMetadata("movie:"+strconv.Itoa(movie.IDs.Trakt), func() (*mediaMetadata, error) {
+		var extended traktExtended
+		_, err := a.traktGet(user, "/movies/"+strconv.Itoa(movie.IDs.Trakt), extendedQuery(), &extended)
+		if err != nil {
+			return nil, err
+		}
+
+		m := extended.metadata()
+		if movie.IDs.TMDb != 0 {
+			m.Photo = a.tmdbImage("/movie/"+strconv.Itoa(movie.IDs.TMDb), "poster")
+		}
+
+		return m, nil
+	})
+}
+
+func (a *app) showMetadata(user *user, show traktShow) (*mediaMetadata, error) {
+	return a.getMetadata("show:"+strconv.Itoa(show.IDs.Trakt), func() (*mediaMetadata, error) {
+		var extended traktExtended
+		_, err := a.traktGet(user, "/shows/"+strconv.Itoa(show.IDs.Trakt), extendedQuery(), &extended)
+		if err != nil {
+			return nil, err
+		}
+
+		m := extended.metadata()
+		if show.IDs.TMDb != 0 {
+			m.Photo = a.tmdbImage("/tv/"+strconv.Itoa(show.IDs.TMDb), "poster")
+		}
+
+		return m, nil
+	})
+}
+
+func (a *app) episodeMetadata(user *user, show traktShow, episode traktEpisode) (*mediaMetadata, error) {
+	return a.getMetadata("episode:"+strconv.Itoa(episode.IDs.Trakt), func() (*mediaMetadata, error) {
+		path := "/seasons/" + strconv.Itoa(episode.Season) + "/episodes/" + strconv.Itoa(episode.Number)
+
+		var extended traktExtended
+		_, err := a.traktGet(user, "/shows/"+strconv.Itoa(show.IDs.Trakt)+path, extendedQuery(), &extended)
+		if err != nil {
+			return nil, err
+		}
+
+		m := extended.metadata()
+		if show.IDs.TMDb != 0 {
+			m.Photo = a.tmdbImage("/tv/"+strconv.Itoa(show.IDs.TMDb)+"/season/"+strconv.Itoa(episode.Season)+"/episode/"+strconv.Itoa(episode.Number), "still")
+		}
+
+		return m, nil
+	})
+}
+
+func extendedQuery() url.Values {
+	q := url.Values{}
+	q.Set("extended", "full")
+	return q
+}
+
+// tmdbImage returns the URL of the poster or still of the TMDb item at path,
+// or an empty string if there is none, or TMDb is not configured.
+func (a *app) tmdbImage(path, kind string) string {
+	if a.TMDbAPIKey == "" {
+		return ""
+	}
+
+	var images struct {
+		PosterPath string `json:"poster_path"`
+		StillPath  string `json:"still_path"`
+	}
+
+	err := a.tmdbGet(path, &images)
+	if err != nil {
+		log.Printf("could not get tmdb %s: %v\n", path, err)
+		return ""
+	}
+
+	imagePath := images.PosterPath
+	if kind == "still" {
+		imagePath = images.StillPath
+	}
+
+	if imagePath == "" {
+		return ""
+	}
+
+	return a.TMDbImageURL + imagePath
+}
+
+func (a *app) tmdbGet(path string, v interface{}) error {
+	u, err := url.Parse(a.TMDbAPIURL + path)
+	if err != nil {
+		return err
+	}
+	u.RawQuery = url.Values{"api_key": []string{a.TMDbAPIKey}}.Encode()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return errors.New("tmdb: status " + strconv.Itoa(res.StatusCode))
+	}
+
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// enrichWatch adds the metadata of the watched movie, or episode and show, to
+// the watch-of of the post. Metadata that cannot be fetched is left out.
+func (a *app) enrichWatch(user *user, item traktHistoryItem, mf2 map[string]interface{}) {
+	properties, _ := mf2["properties"].(map[string]interface{})
+	watch := citeProperties(properties, "watch-of")
+	if watch == nil {
+		return
+	}
+
+	switch item.Type {
+	case "movie":
+		m, err := a.movieMetadata(user, item.Movie)
+		if err != nil {
+			log.Printf("%s - could not get metadata of movie %d: %v\n", user.ProfileURL, item.Movie.IDs.Trakt, err)
+			return
+		}
+		enrichProperties(watch, m)
+	case "episode":
+		m, err := a.episodeMetadata(user, item.Show, item.Episode)
+		if err != nil {
+			log.Printf("%s - could not get metadata of episode %d: %v\n", user.ProfileURL, item.Episode.IDs.Trakt, err)
+		} else {
+			enrichProperties(watch, m)
+		}
+
+		show := citeProperties(watch, "episode-of")
+		m, err = a.showMetadata(user, item.Show)
+		if err != nil {
+			log.Printf("%s - could not get metadata of show %d: %v\n", user.ProfileURL, item.Show.IDs.Trakt, err)
+		} else if show != nil {
+			enrichProperties(show, m)
+
+			if _, ok := watch["photo"]; !ok && m.Photo != "" {
+				// No still for the episode, use the poster of the show.
+				watch["photo"] = []string{m.Photo}
+			}
+		}
+	}
+}
+
+func enrichProperties(properties map[string]interface{}, m *mediaMetadata) {
+	if m.Overview != "" {
+		properties["content"] = []string{m.Overview}
+	}
+
+	if m.Runtime > 0 {
+		properties["duration"] = []string{"PT" + strconv.Itoa(m.Runtime) + "M"}
+	}
+
+	if len(m.Genres) > 0 {
+		properties["category"] = m.Genres
+	}
+
+	if m.Certification != "" {
+		properties["certification"] = []string{m.Certification}
+	}
+
+	if !m.Released.IsZero() {
+		properties["published"] = []string{m.Released.Format(time.RFC3339)}
+	}
+
+	if m.Photo != "" {
+		properties["photo"] = []string{m.Photo}
+	}
+}
+
+// citeProperties returns the properties of the first h-cite of the property,
+// or nil if there is none.
+func citeProperties(properties map[string]interface{}, property string) map[string]interface{} {
+	cites, ok := properties[property].([]interface{})
+	if !ok || len(cites) == 0 {
+		return nil
+	}
+
+	cite, ok := cites[0].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	citeProps, _ := cite["properties"].(map[string]interface{})
+	return citeProps
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newMetadataTestApp returns a test app that enriches posts, with TMDb served
+// by the fake Trakt.
+func newMetadataTestApp(t *testing.T) (*app, *fakeMicropub, *user) {
+	a, mp, u := newTestApp(t, func(s *userSettings) {
+		s.EnrichMetadata = true
+	})
+
+	useFakeTMDb(a)
+	return a, mp, u
+}
+
+// useFakeTMDb makes the app get images from the TMDb of the fake Trakt.
+func useFakeTMDb(a *app) {
+	a.TMDbAPIKey = "tmdb-key"
+	a.TMDbAPIURL = a.TraktAPIURL + "/tmdb"
+	a.TMDbImageURL = a.TraktAPIURL + "/tmdb/images"
+}
+
+func expectProperty(t *testing.T, properties map[string]interface{}, name string, expected ...interface{}) {
+	t.Helper()
+
+	if got, _ := properties[name].([]interface{}); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %s to be %v, got %v", name, expected, properties[name])
+	}
+}
+
+func TestEnrichEpisode(t *testing.T) {
+	a, mp, u := newMetadataTestApp(t)
+
+	a.importCycle(u)
+
+	posts, _ := mp.received()
+	if len(posts) != 5 {
+		t.Fatalf("expected 5 posts, got %d", len(posts))
+	}
+
+	properties, _ := posts[0]["properties"].(map[string]interface{})
+	watch := citeProperties(properties, "watch-of")
+	if watch == nil {
+		t.Fatalf("expected a watch-of, got %v", properties)
+	}
+
+	expectProperty(t, watch, "content", "The overview of Episode 1.")
+	expectProperty(t, watch, "duration", "PT45M")
+	expectProperty(t, watch, "published", "2019-09-01T20:00:00Z")
+	expectProperty(t, watch, "photo", a.TMDbImageURL+"/fake-still.jpg")
+
+	show := citeProperties(watch, "episode-of")
+	if show == nil {
+		t.Fatalf("expected an episode-of, got %v", watch)
+	}
+
+	expectProperty(t, show, "content", "The overview of Fake Show.")
+	expectProperty(t, show, "category", "comedy")
+	expectProperty(t, show, "certification", "TV-PG")
+	expectProperty(t, show, "photo", a.TMDbImageURL+"/fake-poster.jpg")
+
+	for _, key := range []string{"episode:3001", "show:1000"} {
+		if m, err := a.db.getMetadata(key); err != nil || m == nil {
+			t.Errorf("expected %s to be cached, got %v, %v", key, m, err)
+		}
+	}
+}
+
+func TestEnrichMovie(t *testing.T) {
+	a, mp, u := newMetadataTestApp(t)
+
+	movie := historyItem(t, a, 1)
+	movie.ID = 0
+	movie.WatchedAt = time.Now().Add(-time.Minute).UTC().Truncate(time.Second)
+	a.fakeTrakt.add(movie)
+
+	a.importCycle(u)
+
+	posts, _ := mp.received()
+	if len(posts) != 6 {
+		t.Fatalf("expected 6 posts, got %d", len(posts))
+	}
+
+	properties, _ := posts[5]["properties"].(map[string]interface{})
+	watch := citeProperties(properties, "watch-of")
+	if watch == nil {
+		t.Fatalf("expected a watch-of, got %v", properties)
+	}
+
+	expectProperty(t, watch, "name", "Fake Movie 1")
+	expectProperty(t, watch, "category", "drama", "fantasy")
+	expectProperty(t, watch, "certification", "PG-13")
+	expectProperty(t, watch, "duration", "PT120M")
+	expectProperty(t, watch, "published", "2001-06-01T00:00:00Z")
+	expectProperty(t, watch, "photo", a.TMDbImageURL+"/fake-poster.jpg")
+}
+
+func TestEnrichWithoutTMDb(t *testing.T) {
+	a, mp, u := newTestApp(t, func(s *userSettings) {
+		s.EnrichMetadata = true
+	})
+
+	a.importCycle(u)
+
+	posts, _ := mp.received()
+	if len(posts) != 5 {
+		t.Fatalf("expected 5 posts, got %d", len(posts))
+	}
+
+	properties, _ := posts[0]["properties"].(map[string]interface{})
+	watch := citeProperties(properties, "watch-of")
+	expectProperty(t, watch, "duration", "PT45M")
+	if _, ok := watch["photo"]; ok {
+		t.Errorf("expected no photo without TMDb, got %v", watch["photo"])
+	}
+}
+
+func TestGetMetadataCache(t *testing.T) {
+	a, _, _ := newTestApp(t, nil)
+
+	fetches := 0
+	fetch := func() (*mediaMetadata, error) {
+		fetches++
+		return &mediaMetadata{Overview: "Fetched"}, nil
+	}
+
+	for i := 0; i < 2; i++ {
+		m, err := a.getMetadata("movie:1", fetch)
+		if err != nil || m.Overview != "Fetched" {
+			t.Fatalf("expected the fetched metadata, got %v, %v", m, err)
+		}
+	}
+
+	if fetches != 1 {
+		t.Errorf("expected the metadata to be fetched once, got %d", fetches)
+	}
+
+	// Old metadata is fetched again, but still used if that fails.
+	err := a.db.saveMetadata("movie:1", &mediaMetadata{Overview: "Old", FetchedAt: time.Now().Add(-2 * metadataTTL)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := a.getMetadata("movie:1", func() (*mediaMetadata, error) {
+		fetches++
+		return nil, errors.New("trakt is down")
+	})
+	if err != nil || m.Overview != "Old" {
+		t.Errorf("expected the old metadata, got %v, %v", m, err)
+	}
+
+	if fetches != 2 {
+		t.Errorf("expected old metadata to be fetched again, got %d fetches", fetches)
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// sendMicropub posts the item to the user's Micropub endpoint, or updates its
+// live post, and returns the URL of the post, if the endpoint tells us.
+func (a *app) sendMicropub(user *user, item traktHistoryItem) (string, error) {
+	micro, err := a.watchMicroformats(user, item)
+	if err != nil {
+		return "", err
+	}
+
+	if user.UploadPhotos {
+		a.uploadWatchPhoto(user, item, micro)
+	}
+
+	return a.finishWatches(user, traktHistory{item}, micro)
+}
+
+// watchMicroformats converts the item into the post we send for it, following
+// the user's settings. Photos are not uploaded yet.
+func (a *app) watchMicroformats(user *user, item traktHistoryItem) (map[string]interface{}, error) {
+	plays, err := a.countPlays(user, item)
+	if err != nil {
+		// Not worth failing for: send it without the watch count.
+		log.Printf("%s - could not count plays of %d: %v\n", user.ProfileURL, item.ID, err)
+	}
+
+	micro, err := traktToMicroformats(item, plays)
+	if err != nil {
+		return nil, &conversionError{err}
+	}
+
+	if user.EnrichMetadata {
+		a.enrichWatch(user, item, micro)
+	}
+
+	err = applyPostTemplates(user.Templates, item, plays, micro)
+	if err != nil {
+		log.Printf("%s - could not execute templates, using the defaults: %v\n", user.ProfileURL, err)
+	}
+
+	applyPostRule(user.PostRules, item.Type, micro)
+	return micro, nil
+}
+
+// postRule overrides the post status and visibility of the watches of a certain
+// type. Empty values mean the user's defaults are used.
+type postRule struct {
+	PostStatus string
+	Visibility string
+}
+
+// postRules holds the user's rules for movies and episodes.
+type postRules struct {
+	Movie   postRule
+	Episode postRule
+}
+
+func (r postRules) forType(itemType string) postRule {
+	if itemType == "episode" {
+		return r.Episode
+	}
+
+	return r.Movie
+}
+
+// applyPostRule sets the post status and visibility of a watch of the given
+// type, if the user has a rule for it.
+func applyPostRule(rules postRules, itemType string, mf2 map[string]interface{}) {
+	rule := rules.forType(itemType)
+	properties := mf2["properties"].(map[string]interface{})
+
+	if rule.PostStatus != "" {
+		properties["post-status"] = []string{rule.PostStatus}
+	}
+
+	if rule.Visibility != "" {
+		properties["visibility"] = []string{rule.Visibility}
+	}
+}
+
+// createMicropub creates a post with the user's Micropub endpoint, adding the
+// user's defaults where no rule applied, and returns its URL, if the endpoint
+// tells us.
+func (a *app) createMicropub(user *user, mf2 map[string]interface{}) (string, error) {
+	applyDefaults(user, mf2)
+	return a.postMicropub(user, mf2)
+}
+
+// applyDefaults adds the user's syndication targets, and their post status and
+// visibility where no rule applied.
+func applyDefaults(user *user, mf2 map[string]interface{}) {
+	properties := mf2["properties"].(map[string]interface{})
+
+	if len(user.SyndicateTo) > 0 {
+		properties["mp-syndicate-to"] = user.SyndicateTo
+	}
+
+	if _, ok := properties["post-status"]; !ok && user.PostStatus != "" {
+		properties["post-status"] = []string{user.PostStatus}
+	}
+
+	if _, ok := properties["visibility"]; !ok && user.Visibility != "" {
+		properties["visibility"] = []string{user.Visibility}
+	}
+}
+
+// deleteMicropub asks the user's Micropub endpoint to delete the post at the
+// given URL.
+func (a *app) deleteMicropub(user *user, location string) error {
+	_, err := a.postMicropub(user, map[string]interface{}{
+		"action": "delete",
+		"url":    location,
+	})
+	return err
+}
+
+// updateMicropub asks the user's Micropub endpoint to replace the properties of
+// the post at the given URL with those of mf2.
+func (a *app) updateMicropub(user *user, location string, mf2 map[string]interface{}) error {
+	_, err := a.postMicropub(user, map[string]interface{}{
+		"action":  "update",
+		"url":     location,
+		"replace": mf2["properties"],
+	})
+	return err
+}
+
+// postMicropub sends a request to the user's Micropub endpoint and returns the
+// Location header of the response. If the user did not choose how to encode
+// requests, and the endpoint refuses JSON, form encoding is tried and used from
+// then on.
+func (a *app) postMicropub(user *user, body map[string]interface{}) (string, error) {
+	mode := micropubModeFor(user, body)
+
+	location, err := a.doMicropub(user, body, mode)
+	if err != nil && mode == modeJSON && user.MicropubMode == "" && user.DetectedMicropubMode == "" && isJSONRefused(err) {
+		var formErr error
+		location, formErr = a.doMicropub(user, body, modeForm)
+		if formErr != nil {
+			return "", err
+		}
+
+		log.Printf("%s - micropub endpoint does not support json, using forms\n", user.ProfileURL)
+		user.DetectedMicropubMode = modeForm
+		_, err = a.db.updateSettings(user.ProfileURL, func(settings *userSettings) {
+			settings.DetectedMicropubMode = modeForm
+		})
+		if err != nil {
+			log.Printf("%s - could not save user: %v\n", user.ProfileURL, err)
+		}
+	}
+
+	return location, err
+}
+
+// doMicropub sends a request to the user's Micropub endpoint, encoded according
+// to mode, and returns the Location header of the response.
+func (a *app) doMicropub(user *user, body map[string]interface{}, mode string) (string, error) {
+	data, contentType, err := encodeMicropub(body, mode)
+	if err != nil {
+		return "", err
+	}
+
+	httpClient, err := a.getMicropubClient(user)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*10)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", user.MicropubEndpoint, bytes.NewBuffer(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp.Header.Get("Location"), nil
+	}
+
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	err = &micropubError{
+		ProfileURL: user.ProfileURL,
+		StatusCode: resp.StatusCode,
+		Body:       string(bodyBytes),
+	}
+	a.checkMicropubUnauthorized(user, err)
+	return "", err
+}
+
+// micropubConfig is the response to a q=config query.
+type micropubConfig struct {
+	MediaEndpoint string             `json:"media-endpoint"`
+	SyndicateTo   []micropubTarget   `json:"syndicate-to"`
+	PostTypes     []micropubPostType `json:"post-types"`
+}
+
+type micropubTarget struct {
+	UID  string `json:"uid"`
+	Name string `json:"name"`
+}
+
+type micropubPostType struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+}
+
+// hasTarget returns whether uid is one of the syndication targets.
+func (c *micropubConfig) hasTarget(uid string) bool {
+	for _, target := range c.SyndicateTo {
+		if target.UID == uid {
+			return true
+		}
+	}
+
+	return false
+}
+
+// refreshMicropubConfig queries the configuration of the user's Micropub
+// endpoint and stores it. Defaults that no longer apply are dropped.
+func (a *app) refreshMicropubConfig(user *user) error {
+	config, err := a.getMicropubConfig(user)
+	if err != nil {
+		return err
+	}
+
+	user.userSettings, err = a.db.updateSettings(user.ProfileURL, func(settings *userSettings) {
+		settings.MicropubConfig = config
+		settings.MicropubConfigAt = time.Now()
+
+		syndicateTo := []string{}
+		for _, uid := range settings.SyndicateTo {
+			if config.hasTarget(uid) {
+				syndicateTo = append(syndicateTo, uid)
+			}
+		}
+		settings.SyndicateTo = syndicateTo
+	})
+	return err
+}
+
+// getMicropubConfig queries the configuration of the user's Micropub endpoint.
+func (a *app) getMicropubConfig(user *user) (*micropubConfig, error) {
+	u, err := url.Parse(user.MicropubEndpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	q := u.Query()
+	q.Set("q", "config")
+	u.RawQuery = q.Encode()
+
+	httpClient, err := a.getMicropubClient(user)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		bodyBytes, _ := ioutil.ReadAll(resp.Body)
+		return nil, &micropubError{
+			ProfileURL: user.ProfileURL,
+			StatusCode: resp.StatusCode,
+			Body:       string(bodyBytes),
+		}
+	}
+
+	config := &micropubConfig{}
+	return config, json.NewDecoder(resp.Body).Decode(config)
+}
+
+type micropubError struct {
+	ProfileURL string
+	StatusCode int
+	Body       string
+}
+
+func (e *micropubError) Error() string {
+	return e.ProfileURL +
+		": status from micropub endpoint was " +
+		strconv.Itoa(e.StatusCode) +
+		" body: " +
+		e.Body
+}
+
+// isUnauthorized returns whether the Micropub endpoint refused the user's token.
+// The items are not at fault: they are sent once the user reconnects.
+func isUnauthorized(err error) bool {
+	var mErr *micropubError
+	return errors.As(err, &mErr) &&
+		(mErr.StatusCode == http.StatusUnauthorized || mErr.StatusCode == http.StatusForbidden)
+}
+
+// checkMicropubUnauthorized records that the user must reconnect if the Micropub
+// endpoint refused their token, as traktGet does for Trakt.
+func (a *app) checkMicropubUnauthorized(user *user, err error) {
+	if isUnauthorized(err) && user.IndieTokenError == "" {
+		a.updateTokens(user, "indie", err, func(t *userTokens) {
+			t.IndieTokenError = err.Error()
+		})
+	}
+}
+
+// isPermanent returns whether retrying the request that caused err is pointless.
+// Client errors are permanent, except for timeouts, rate limiting and refused
+// tokens. Server and network errors are transient.
+func isPermanent(err error) bool {
+	var mErr *micropubError
+	if errors.As(err, &mErr) {
+		return mErr.StatusCode >= 400 && mErr.StatusCode < 500 &&
+			mErr.StatusCode != http.StatusRequestTimeout &&
+			mErr.StatusCode != http.StatusTooManyRequests &&
+			!isUnauthorized(err)
+	}
+
+	var cErr *conversionError
+	return errors.As(err, &cErr)
+}
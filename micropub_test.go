@@ -0,0 +1,143 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRefreshMicropubConfig(t *testing.T) {
+	a, mp, u := newTestApp(t, func(s *userSettings) {
+		s.SyndicateTo = []string{"https://social.example/@me", "https://gone.example/"}
+	})
+
+	config := &micropubConfig{
+		MediaEndpoint: u.MicropubEndpoint + "/media",
+		SyndicateTo: []micropubTarget{
+			{UID: "https://social.example/@me", Name: "Social"},
+			{UID: "https://other.example/", Name: "Other"},
+		},
+		PostTypes: []micropubPostType{{Type: "watch", Name: "Watch"}},
+	}
+	mp.setConfig(config)
+
+	err := a.refreshMicropubConfig(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := a.db.get(u.ProfileURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(stored.MicropubConfig, config) {
+		t.Errorf("expected the config to be stored, got %+v", stored.MicropubConfig)
+	}
+
+	if stored.MicropubConfigAt.IsZero() {
+		t.Error("expected the time of the config to be stored")
+	}
+
+	// Targets the endpoint no longer offers are dropped.
+	expected := []string{"https://social.example/@me"}
+	if !reflect.DeepEqual(stored.SyndicateTo, expected) || !reflect.DeepEqual(u.SyndicateTo, expected) {
+		t.Errorf("expected the syndication targets to be %v, got %v", expected, stored.SyndicateTo)
+	}
+}
+
+func TestRefreshMicropubConfigFails(t *testing.T) {
+	a, mp, u := newTestApp(t, func(s *userSettings) {
+		s.SyndicateTo = []string{"https://social.example/@me"}
+	})
+
+	mp.failNext(1, 400, "invalid_request")
+
+	if err := a.refreshMicropubConfig(u); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	stored, err := a.db.get(u.ProfileURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stored.MicropubConfig != nil || len(stored.SyndicateTo) != 1 {
+		t.Errorf("expected the settings to be kept, got %+v and %v", stored.MicropubConfig, stored.SyndicateTo)
+	}
+}
+
+func TestPostDefaults(t *testing.T) {
+	a, mp, u := newTestApp(t, func(s *userSettings) {
+		s.SyndicateTo = []string{"https://social.example/@me"}
+		s.PostStatus = "draft"
+		s.Visibility = "unlisted"
+	})
+
+	a.importCycle(u)
+
+	posts, _ := mp.received()
+	if len(posts) != 5 {
+		t.Fatalf("expected 5 posts, got %d", len(posts))
+	}
+
+	for _, post := range posts {
+		properties, _ := post["properties"].(map[string]interface{})
+		expectProperty(t, properties, "mp-syndicate-to", "https://social.example/@me")
+		expectProperty(t, properties, "post-status", "draft")
+		expectProperty(t, properties, "visibility", "unlisted")
+	}
+}
+
+func TestPostRules(t *testing.T) {
+	a, mp, u := newTestApp(t, func(s *userSettings) {
+		s.PostStatus = "published"
+		s.Visibility = "public"
+		s.PostRules = postRules{
+			Movie:   postRule{PostStatus: "draft"},
+			Episode: postRule{Visibility: "unlisted"},
+		}
+	})
+
+	a.fakeTrakt.add(traktHistoryItem{
+		Type:      "movie",
+		Action:    "watch",
+		WatchedAt: time.Now().Add(-time.Minute).UTC().Truncate(time.Second),
+		Movie:     traktMovie{Title: "Fake Movie 4", Year: 2004, IDs: traktIDs{Trakt: 2004}},
+	})
+
+	a.importCycle(u)
+
+	posts, _ := mp.received()
+	if len(posts) != 6 {
+		t.Fatalf("expected 6 posts, got %d", len(posts))
+	}
+
+	// Rules win over the defaults, which fill in the rest.
+	for _, post := range posts[:5] {
+		properties, _ := post["properties"].(map[string]interface{})
+		expectProperty(t, properties, "post-status", "published")
+		expectProperty(t, properties, "visibility", "unlisted")
+	}
+
+	properties, _ := posts[5]["properties"].(map[string]interface{})
+	expectProperty(t, properties, "post-status", "draft")
+	expectProperty(t, properties, "visibility", "public")
+}
+
+func TestNoPostStatus(t *testing.T) {
+	mf2, err := traktToMicroformats(samplePostItem("movie"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	applyPostRule(postRules{}, "movie", mf2)
+	applyDefaults(&user{}, mf2)
+
+	properties := mf2["properties"].(map[string]interface{})
+	for _, name := range []string{"post-status", "visibility", "mp-syndicate-to"} {
+		if _, ok := properties[name]; ok {
+			t.Errorf("expected no %s without settings, got %v", name, properties[name])
+		}
+	}
+}
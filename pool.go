@@ -0,0 +1,96 @@
+package main
+
+import (
+	"sync"
+)
+
+type poolJob struct {
+	key string
+	fn  func()
+}
+
+// pool runs jobs with bounded concurrency, in the order they were submitted.
+// There is at most one queued or running job per key, i.e., per user.
+type pool struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queue   []poolJob
+	pending map[string]bool
+	closed  bool
+	workers sync.WaitGroup
+}
+
+func newPool(workers int) *pool {
+	p := &pool{
+		pending: map[string]bool{},
+	}
+	p.cond = sync.NewCond(&p.mu)
+
+	p.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+
+	return p
+}
+
+// submit queues the job, unless there is already one for the same key, in which
+// case it returns false.
+func (p *pool) submit(key string, fn func()) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed || p.pending[key] {
+		return false
+	}
+
+	p.pending[key] = true
+	p.queue = append(p.queue, poolJob{key: key, fn: fn})
+	p.cond.Signal()
+	return true
+}
+
+// busy returns whether there is a queued or running job for the key.
+func (p *pool) busy(key string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.pending[key]
+}
+
+// close stops the workers and waits for them to finish their current job. Queued
+// jobs are discarded.
+func (p *pool) close() {
+	p.mu.Lock()
+	p.closed = true
+	p.queue = nil
+	p.cond.Broadcast()
+	p.mu.Unlock()
+
+	p.workers.Wait()
+}
+
+func (p *pool) work() {
+	defer p.workers.Done()
+
+	for {
+		p.mu.Lock()
+		for len(p.queue) == 0 && !p.closed {
+			p.cond.Wait()
+		}
+
+		if p.closed {
+			p.mu.Unlock()
+			return
+		}
+
+		job := p.queue[0]
+		p.queue = p.queue[1:]
+		p.mu.Unlock()
+
+		job.fn()
+
+		p.mu.Lock()
+		delete(p.pending, job.key)
+		p.mu.Unlock()
+	}
+}
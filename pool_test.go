@@ -0,0 +1,106 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPoolOneJobPerKey(t *testing.T) {
+	p := newPool(2)
+	defer p.close()
+
+	release := make(chan struct{})
+	var done sync.WaitGroup
+	done.Add(1)
+
+	if !p.submit("a", func() { <-release; done.Done() }) {
+		t.Fatal("expected the first job to be queued")
+	}
+
+	if p.submit("a", func() {}) {
+		t.Error("expected a second job for the same key to be refused")
+	}
+
+	if !p.busy("a") {
+		t.Error("expected the key to be busy")
+	}
+
+	close(release)
+	done.Wait()
+
+	// The key is freed right after the job returns.
+	deadline := time.Now().Add(time.Second)
+	for p.busy("a") && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	if !p.submit("a", func() {}) {
+		t.Error("expected a job to be queued once the previous one finished")
+	}
+}
+
+func TestPoolBoundsConcurrency(t *testing.T) {
+	p := newPool(2)
+	defer p.close()
+
+	var running, most int32
+	var done sync.WaitGroup
+
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		done.Add(1)
+		p.submit(key, func() {
+			defer done.Done()
+
+			n := atomic.AddInt32(&running, 1)
+			for {
+				m := atomic.LoadInt32(&most)
+				if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+					break
+				}
+			}
+
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+		})
+	}
+
+	done.Wait()
+
+	if most > 2 {
+		t.Errorf("expected at most 2 jobs at once, got %d", most)
+	}
+}
+
+func TestPoolClosed(t *testing.T) {
+	p := newPool(1)
+	p.close()
+
+	if p.submit("a", func() {}) {
+		t.Error("expected a closed pool to refuse jobs")
+	}
+}
+
+func TestPoolCloseWaitsForRunningJobs(t *testing.T) {
+	p := newPool(1)
+
+	started := make(chan struct{})
+	var finished int32
+
+	p.submit("a", func() {
+		close(started)
+		time.Sleep(20 * time.Millisecond)
+		atomic.StoreInt32(&finished, 1)
+	})
+	p.submit("b", func() {
+		t.Error("expected queued jobs to be discarded")
+	})
+
+	<-started
+	p.close()
+
+	if atomic.LoadInt32(&finished) != 1 {
+		t.Error("expected close to wait for the running job")
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+)
+
+// maxTemplateOutput is the maximum length of the output of a user template.
+const maxTemplateOutput = 4096
+
+var (
+	errTemplateTooLong  = errors.New("template output is too long")
+	errTemplateCall     = errors.New("templates cannot call other templates")
+	errTemplateRange    = errors.New("range can only be used on lists of the watch")
+	errTemplateFormat   = errors.New("printf widths and precisions must be shorter than 5 digits")
+	templateFormatWidth = regexp.MustCompile(`%%|%[^%a-zA-Z]*(\*|[0-9]{5})`)
+)
+
+// postTemplate holds the user's templates for the text of a post. Empty
+// templates are not used.
+type postTemplate struct {
+	Summary string
+	Content string
+	Name    string
+}
+
+// postTemplates holds the user's templates for movies and episodes.
+type postTemplates struct {
+	Movie   postTemplate
+	Episode postTemplate
+}
+
+func (t postTemplates) forType(itemType string) postTemplate {
+	if itemType == "episode" {
+		return t.Episode
+	}
+
+	return t.Movie
+}
+
+// postTemplateData is what the templates have access to.
+type postTemplateData struct {
+	Title     string
+	Type      string
+	Action    string
+	WatchedAt time.Time
+	Movie     traktMovie
+	Show      traktShow
+	Episode   traktEpisode
+	Plays     int
+	Rewatch   bool
+}
+
+func newPostTemplateData(item traktHistoryItem, plays int) postTemplateData {
+	return postTemplateData{
+		Title:     item.title(),
+		Type:      item.Type,
+		Action:    item.Action,
+		WatchedAt: item.WatchedAt,
+		Movie:     item.Movie,
+		Show:      item.Show,
+		Episode:   item.Episode,
+		Plays:     plays,
+		Rewatch:   plays > 1,
+	}
+}
+
+// postTexts is the result of executing a postTemplate.
+type postTexts struct {
+	Summary string
+	Content string
+	Name    string
+}
+
+func (t postTemplate) execute(data postTemplateData) (postTexts, error) {
+	var texts postTexts
+	var err error
+
+	texts.Summary, err = executeTemplate("summary", t.Summary, data)
+	if err != nil {
+		return texts, err
+	}
+
+	texts.Content, err = executeTemplate("content", t.Content, data)
+	if err != nil {
+		return texts, err
+	}
+
+	texts.Name, err = executeTemplate("name", t.Name, data)
+	return texts, err
+}
+
+func executeTemplate(name, text string, data postTemplateData) (string, error) {
+	if text == "" {
+		return "", nil
+	}
+
+	tmpl, err := template.New(name).Option("missingkey=error").Funcs(template.FuncMap{"printf": templatePrintf}).Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	err = checkTemplate(tmpl)
+	if err != nil {
+		return "", err
+	}
+
+	var buf limitedBuffer
+	err = tmpl.Execute(&buf, data)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// checkTemplate rejects the templates that could run for too long, as they
+// cannot be stopped once started: ranges over anything but the lists of
+// postTemplateData, e.g., {{range 100000000000}}, and calls to other
+// templates, which can recurse or multiply the work. Templates are checked
+// every time they run, so that ones saved before a rule was added are caught.
+func checkTemplate(tmpl *template.Template) error {
+	for _, t := range tmpl.Templates() {
+		if t.Tree == nil {
+			continue
+		}
+
+		if t.Name() != tmpl.Name() {
+			return errTemplateCall
+		}
+
+		err := checkTemplateNode(t.Tree.Root, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkTemplateNode checks node and its children. atRoot is whether the dot is
+// still the postTemplateData, which is not known inside range and with.
+func checkTemplateNode(node parse.Node, atRoot bool) error {
+	switch node := node.(type) {
+	case *parse.ListNode:
+		if node == nil {
+			return nil
+		}
+
+		for _, n := range node.Nodes {
+			err := checkTemplateNode(n, atRoot)
+			if err != nil {
+				return err
+			}
+		}
+	case *parse.TemplateNode:
+		return errTemplateCall
+	case *parse.IfNode:
+		return checkTemplateBranch(&node.BranchNode, atRoot, atRoot)
+	case *parse.WithNode:
+		return checkTemplateBranch(&node.BranchNode, false, atRoot)
+	case *parse.RangeNode:
+		if !isTemplateList(node.Pipe, atRoot) {
+			return errTemplateRange
+		}
+
+		return checkTemplateBranch(&node.BranchNode, false, atRoot)
+	}
+
+	return nil
+}
+
+func checkTemplateBranch(node *parse.BranchNode, listAtRoot, elseAtRoot bool) error {
+	err := checkTemplateNode(node.List, listAtRoot)
+	if err != nil {
+		return err
+	}
+
+	return checkTemplateNode(node.ElseList, elseAtRoot)
+}
+
+// isTemplateList returns whether pipe is a field of postTemplateData, e.g.,
+// .Show.Title or $.Show.Title, that is a slice, an array or a map.
+func isTemplateList(pipe *parse.PipeNode, atRoot bool) bool {
+	if len(pipe.Cmds) != 1 || len(pipe.Cmds[0].Args) != 1 {
+		return false
+	}
+
+	var fields []string
+	switch arg := pipe.Cmds[0].Args[0].(type) {
+	case *parse.FieldNode:
+		if !atRoot {
+			return false
+		}
+		fields = arg.Ident
+	case *parse.VariableNode:
+		if arg.Ident[0] != "$" {
+			return false
+		}
+		fields = arg.Ident[1:]
+	default:
+		return false
+	}
+
+	t := reflect.TypeOf(postTemplateData{})
+	for _, name := range fields {
+		if t.Kind() != reflect.Struct {
+			return false
+		}
+
+		field, ok := t.FieldByName(name)
+		if !ok {
+			return false
+		}
+		t = field.Type
+	}
+
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return true
+	}
+
+	return false
+}
+
+// templatePrintf is fmt.Sprintf without the widths and precisions that would
+// make it allocate more than the output of a template can hold.
+func templatePrintf(format string, args ...interface{}) (string, error) {
+	for _, match := range templateFormatWidth.FindAllStringSubmatch(format, -1) {
+		if match[1] != "" {
+			return "", errTemplateFormat
+		}
+	}
+
+	return fmt.Sprintf(format, args...), nil
+}
+
+// limitedBuffer is a buffer that refuses to grow beyond maxTemplateOutput.
+type limitedBuffer struct {
+	bytes.Buffer
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > maxTemplateOutput {
+		return 0, errTemplateTooLong
+	}
+
+	return b.Buffer.Write(p)
+}
+
+// applyPostTemplates replaces the summary, and sets the content and name, of
+// the watch with the output of the user's templates. Nothing is changed if one
+// of the templates fails.
+func applyPostTemplates(tmpls postTemplates, item traktHistoryItem, plays int, mf2 map[string]interface{}) error {
+	texts, err := tmpls.forType(item.Type).execute(newPostTemplateData(item, plays))
+	if err != nil {
+		return err
+	}
+
+	properties := mf2["properties"].(map[string]interface{})
+
+	if texts.Summary != "" {
+		properties["summary"] = []string{texts.Summary}
+	}
+
+	if texts.Content != "" {
+		properties["content"] = []string{texts.Content}
+	}
+
+	if texts.Name != "" {
+		properties["name"] = []string{texts.Name}
+	}
+
+	return nil
+}
+
+// previewPost returns the JSON that would be posted for a sample watch of the
+// given type with the templates. It also serves to validate them.
+func previewPost(tmpls postTemplates, itemType string) (string, error) {
+	item := samplePostItem(itemType)
+
+	micro, err := traktToMicroformats(item, 1)
+	if err != nil {
+		return "", err
+	}
+
+	err = applyPostTemplates(tmpls, item, 1, micro)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := json.MarshalIndent(micro, "", "  ")
+	return string(data), err
+}
+
+// samplePostItem returns a watch used to validate and preview the templates.
+func samplePostItem(itemType string) traktHistoryItem {
+	watchedAt := time.Date(2020, 1, 17, 22, 31, 25, 0, time.UTC)
+
+	if itemType == "episode" {
+		return traktHistoryItem{
+			ID:        5611853643,
+			WatchedAt: watchedAt,
+			Action:    "scrobble",
+			Type:      "episode",
+			Episode: traktEpisode{
+				Title:  "A Party, Sweatpants and a Sweater for the Cat",
+				Season: 3,
+				Number: 11,
+				IDs:    traktIDs{Trakt: 3919434, IMDb: "tt10998154", TMDb: 2019305, TVDb: 7550838},
+			},
+			Show: traktShow{
+				Title: "Young Sheldon",
+				Year:  2017,
+				IDs:   traktIDs{Trakt: 118164, Slug: "young-sheldon", IMDb: "tt6226232", TMDb: 71728, TVDb: 328724},
+			},
+		}
+	}
+
+	return traktHistoryItem{
+		ID:        5611853642,
+		WatchedAt: watchedAt,
+		Action:    "watch",
+		Type:      "movie",
+		Movie: traktMovie{
+			Title: "Maleficent: Mistress of Evil",
+			Year:  2019,
+			IDs:   traktIDs{Trakt: 265465, Slug: "maleficent-mistress-of-evil-2019", IMDb: "tt4777008", TMDb: 420809},
+		},
+	}
+}
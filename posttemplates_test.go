@@ -0,0 +1,115 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExecuteTemplate(t *testing.T) {
+	data := newPostTemplateData(samplePostItem("episode"), 2)
+
+	tests := map[string]string{
+		"": "",
+		"  {{ .Show.Title }} S{{ .Episode.Season }}E{{ .Episode.Number }}\n":     "Young Sheldon S3E11",
+		"{{ if .Rewatch }}Rewatched{{ else }}Watched{{ end }} {{ .Show.Title }}": "Rewatched Young Sheldon",
+		"{{ with .Show }}{{ .Year }}{{ end }}":                                   "2017",
+		`{{ printf "%03d %% %s" .Plays .Type }}`:                                 "002 % episode",
+	}
+
+	for text, expected := range tests {
+		got, err := executeTemplate("summary", text, data)
+		if err != nil {
+			t.Errorf("%q: %v", text, err)
+		} else if got != expected {
+			t.Errorf("%q: expected %q, got %q", text, expected, got)
+		}
+	}
+}
+
+func TestExecuteTemplateRejectsUnbounded(t *testing.T) {
+	data := newPostTemplateData(samplePostItem("movie"), 1)
+
+	tests := map[string]error{
+		"{{ range .Plays }}{{ end }}":                                                  errTemplateRange,
+		"{{ range $.Movie.Year }}{{ end }}":                                            errTemplateRange,
+		"{{ $n := .Plays }}{{ range $n }}{{ end }}":                                    errTemplateRange,
+		"{{ with .Movie }}{{ range .Year }}{{ end }}{{ end }}":                         errTemplateRange,
+		"{{ if eq .Type \"episode\" }}{{ range .Episode.Season }}{{ end }}{{ end }}":   errTemplateRange,
+		"{{ define \"loop\" }}{{ template \"loop\" }}{{ end }}{{ template \"loop\" }}": errTemplateCall,
+		"{{ block \"name\" . }}{{ .Title }}{{ end }}":                                  errTemplateCall,
+		`{{ printf "%099999d" 1 }}`:                                                    errTemplateFormat,
+		`{{ printf "%*d" 100000000 1 }}`:                                               errTemplateFormat,
+		`{{ printf "%.100000f" 1.0 }}`:                                                 errTemplateFormat,
+	}
+
+	for text, expected := range tests {
+		_, err := executeTemplate("summary", text, data)
+		if err == nil || !strings.Contains(err.Error(), expected.Error()) {
+			t.Errorf("%q: expected %v, got %v", text, expected, err)
+		}
+	}
+}
+
+func TestExecuteTemplateLimitsOutput(t *testing.T) {
+	data := newPostTemplateData(samplePostItem("movie"), 1)
+	text := strings.Repeat("{{ .Title }}", maxTemplateOutput)
+
+	_, err := executeTemplate("summary", text, data)
+	if err == nil || !strings.Contains(err.Error(), errTemplateTooLong.Error()) {
+		t.Errorf("expected %v, got %v", errTemplateTooLong, err)
+	}
+}
+
+func TestPreviewPost(t *testing.T) {
+	tmpls := postTemplates{
+		Movie: postTemplate{Summary: "Saw {{ .Movie.Title }}", Name: "{{ .Movie.Year }}"},
+	}
+
+	preview, err := previewPost(tmpls, "movie")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{`"Saw Maleficent: Mistress of Evil"`, `"2019"`} {
+		if !strings.Contains(preview, expected) {
+			t.Errorf("expected %s in the preview, got %s", expected, preview)
+		}
+	}
+
+	// The range is never reached with the sample watch, but it is still refused.
+	tmpls.Movie.Content = "{{ if .Rewatch }}{{ range 100000000000 }}{{ end }}{{ end }}"
+	if _, err := previewPost(tmpls, "movie"); err == nil {
+		t.Error("expected an unbounded range to be refused")
+	}
+}
+
+func TestImportUsesTemplates(t *testing.T) {
+	a, mp, u := newTestApp(t, func(s *userSettings) {
+		s.Templates.Episode.Summary = "Caught up on {{ .Show.Title }}"
+		s.Templates.Movie.Summary = "Saw {{ .Title }}{{ if .Rewatch }}{{ range .Plays }}{{ end }}{{ end }}"
+	})
+
+	a.fakeTrakt.add(traktHistoryItem{
+		Type:      "movie",
+		Action:    "watch",
+		WatchedAt: time.Now().Add(-time.Minute).UTC().Truncate(time.Second),
+		Movie:     traktMovie{Title: "Fake Movie 4", Year: 2004, IDs: traktIDs{Trakt: 2004}},
+	})
+
+	a.importCycle(u)
+
+	posts, _ := mp.received()
+	if len(posts) != 6 {
+		t.Fatalf("expected 6 posts, got %d", len(posts))
+	}
+
+	if got := summary(posts[0]); got != "Caught up on Fake Show" {
+		t.Errorf("expected the episode template to be used, got %q", got)
+	}
+
+	// Templates saved before they were refused fall back to the default texts.
+	if got := summary(posts[5]); got != "Just watched: Fake Movie 4" {
+		t.Errorf("expected the default summary, got %q", got)
+	}
+}
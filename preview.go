@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// previewLimit is how many items a preview looks at, at most, to keep it from
+	// using too many Trakt requests.
+	previewLimit = 20
+	// previewTTL is for how long a preview is shown before it is made again.
+	previewTTL = time.Minute * 5
+)
+
+// previewItem is what the next import would do with an item of the history.
+type previewItem struct {
+	ID        int64     `json:"id"`
+	Title     string    `json:"title"`
+	WatchedAt time.Time `json:"watchedAt"`
+	// Reason says why the item would be skipped, if it would.
+	Reason       string                 `json:"reason,omitempty"`
+	Microformats map[string]interface{} `json:"microformats,omitempty"`
+	// JSON is Microformats, indented, for the preview page.
+	JSON string `json:"-"`
+}
+
+// previewResult is a preview made in the background, kept for the preview page.
+type previewResult struct {
+	Items  []previewItem
+	Error  string
+	MadeAt time.Time
+}
+
+// previewCache holds the latest preview of each user, for each direction.
+type previewCache struct {
+	mu      sync.Mutex
+	results map[string]*previewResult
+}
+
+func newPreviewCache() *previewCache {
+	return &previewCache{
+		results: map[string]*previewResult{},
+	}
+}
+
+func previewKey(profileURL string, older bool) string {
+	if older {
+		return profileURL + " older"
+	}
+
+	return profileURL + " newer"
+}
+
+// getPreview returns the latest preview for the user, if it is recent enough.
+// Otherwise, it starts making one in the background and returns nil. Errors
+// are only returned once, so that the next call tries again.
+func (a *app) getPreview(profileURL string, older bool) *previewResult {
+	key := previewKey(profileURL, older)
+
+	a.previews.mu.Lock()
+	result := a.previews.results[key]
+	if result != nil && result.Error != "" {
+		delete(a.previews.results, key)
+	}
+	a.previews.mu.Unlock()
+
+	if result != nil && (result.Error != "" || time.Since(result.MadeAt) < previewTTL) {
+		return result
+	}
+
+	// Skipped if the user is being imported, or a preview is being made already.
+	a.submit(profileURL, func(user *user) {
+		a.makePreview(user, older)
+	})
+	return nil
+}
+
+// makePreview is previewImport as a job for the pool, keeping its result for
+// getPreview.
+func (a *app) makePreview(user *user, older bool) {
+	items, err := a.previewImport(user, older)
+
+	result := &previewResult{
+		Items:  items,
+		MadeAt: time.Now(),
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	a.previews.mu.Lock()
+	a.previews.results[previewKey(user.ProfileURL, older)] = result
+	a.previews.mu.Unlock()
+}
+
+// previewImport returns what importing the newer, or older, items of the
+// history would post, without posting anything or moving the watermarks. Like
+// the imports started from the home page, only the first page is looked at, and
+// at most previewLimit items of it. Items that were already handled are left
+// out. Photos are not uploaded, and binges are shown as separate watches.
+func (a *app) previewImport(user *user, older bool) ([]previewItem, error) {
+	var history traktHistory
+	var err error
+
+	if older {
+		history, _, err = a.importRequest(user, 1, time.Time{}, user.OldestFetchedTime)
+	} else {
+		history, _, err = a.importRequest(user, 1, user.NewestFetchedTime, time.Time{})
+		sort.SliceStable(history, func(i, j int) bool {
+			return history[i].WatchedAt.Before(history[j].WatchedAt)
+		})
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	items := []previewItem{}
+
+	for _, record := range history {
+		if len(items) >= previewLimit {
+			break
+		}
+
+		if record.ID == user.NewestFetchedID || record.ID == user.OldestFetchedID {
+			continue
+		}
+
+		existing, err := a.db.getDelivery(user.ProfileURL, historyKind, historyKey(record.ID))
+		if err != nil {
+			return nil, err
+		}
+
+		if existing != nil && existing.Status != deliveryFailed {
+			continue
+		}
+
+		item := previewItem{
+			ID:        record.ID,
+			Title:     record.title(),
+			WatchedAt: record.WatchedAt,
+		}
+
+		item.Reason, err = a.filterReason(user, record)
+		if err != nil {
+			return nil, err
+		}
+
+		if item.Reason == "" {
+			item.Microformats, err = a.watchMicroformats(user, record)
+			if err != nil {
+				item.Reason = "could not be converted: " + err.Error()
+			} else {
+				applyDefaults(user, item.Microformats)
+
+				data, err := json.MarshalIndent(item.Microformats, "", "  ")
+				if err != nil {
+					return nil, err
+				}
+				item.JSON = string(data)
+			}
+		}
+
+		items = append(items, item)
+	}
+
+	return items, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPreviewImportNewer(t *testing.T) {
+	a, mp, u := newTestApp(t, nil)
+
+	// Items that were handled already are left out.
+	d := newHistoryDelivery(historyItem(t, a, 4))
+	d.Status = deliveryDelivered
+	err := a.db.saveDelivery(u.ProfileURL, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	items, err := a.previewImport(u, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(items) != 4 {
+		t.Fatalf("expected the 4 other episodes, got %d items", len(items))
+	}
+
+	for i, item := range items {
+		expected := fmt.Sprintf("Just watched: Episode %d (Fake Show S1E%d)", i+2, i+2)
+		if item.ID != int64(i+5) || !strings.Contains(item.JSON, `"`+expected+`"`) {
+			t.Errorf("item %d: expected %q, got %+v", i, expected, item)
+		}
+	}
+
+	posts, forms := mp.received()
+	if len(posts)+len(forms) != 0 {
+		t.Errorf("expected nothing to be posted, got %d posts", len(posts)+len(forms))
+	}
+
+	stored, err := a.db.get(u.ProfileURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !stored.NewestFetchedTime.Equal(u.NewestFetchedTime) || stored.NewestFetchedID != u.NewestFetchedID {
+		t.Error("expected the watermarks not to move")
+	}
+}
+
+func TestPreviewImportOlder(t *testing.T) {
+	a, _, u := newTestApp(t, func(s *userSettings) {
+		s.Filters = []filterRule{{Exclude: true, Type: "movie"}}
+	})
+
+	items, err := a.previewImport(u, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(items) != 3 {
+		t.Fatalf("expected the 3 movies, got %d items", len(items))
+	}
+
+	for _, item := range items {
+		if item.Reason == "" || item.Microformats != nil {
+			t.Errorf("expected %s to be skipped, got %+v", item.Title, item)
+		}
+	}
+}
+
+func TestPreviewImportLimit(t *testing.T) {
+	a, _, u := newTestApp(t, nil)
+
+	watchedAt := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	for i := 0; i < previewLimit; i++ {
+		a.fakeTrakt.add(traktHistoryItem{
+			Type:      "movie",
+			Action:    "watch",
+			WatchedAt: watchedAt.Add(time.Duration(i) * time.Second),
+			Movie:     traktMovie{Title: fmt.Sprintf("New Movie %d", i), Year: 2020, IDs: traktIDs{Trakt: 5000 + i}},
+		})
+	}
+
+	items, err := a.previewImport(u, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(items) != previewLimit {
+		t.Errorf("expected %d items, got %d", previewLimit, len(items))
+	}
+}
+
+func TestGetPreview(t *testing.T) {
+	a, _, u := newTestApp(t, nil)
+
+	if result := a.getPreview(u.ProfileURL, false); result != nil {
+		t.Fatalf("expected the preview to be made in the background, got %+v", result)
+	}
+
+	var result *previewResult
+	deadline := time.Now().Add(5 * time.Second)
+	for result == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		result = a.getPreview(u.ProfileURL, false)
+	}
+
+	if result == nil {
+		t.Fatal("expected the preview to be ready")
+	}
+
+	if result.Error != "" || len(result.Items) != 5 {
+		t.Errorf("expected the 5 episodes, got %d items and %q", len(result.Items), result.Error)
+	}
+
+	// The same preview is shown until it is too old.
+	if again := a.getPreview(u.ProfileURL, false); again != result {
+		t.Error("expected the preview to be kept")
+	}
+
+	if older := a.getPreview(u.ProfileURL, true); older != nil {
+		t.Error("expected the older preview to be made separately")
+	}
+}
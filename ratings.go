@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+)
+
+func newRatingDelivery(item traktRating) *delivery {
+	return &delivery{
+		Key:    fmt.Sprintf("%s-%d-%d", item.Type, item.traktID(), item.RatedAt.Unix()),
+		Kind:   ratingsKind,
+		Title:  item.title(),
+		Date:   item.RatedAt,
+		Rating: &item,
+	}
+}
+
+func (a *app) deliverRating(user *user, item traktRating) (bool, error) {
+	return a.deliver(user, newRatingDelivery(item), func() (string, error) {
+		micro, err := traktRatingToMicroformats(item)
+		if err != nil {
+			return "", &conversionError{err}
+		}
+
+		return a.createMicropub(user, micro)
+	})
+}
+
+// importRatings sends the ratings made since the last imported one, oldest
+// first. If limit is not zero, it stops after handling that many ratings.
+func (a *app) importRatings(user *user, limit int) {
+	var ratings traktRatings
+	_, err := a.traktGet(user, "/sync/ratings", nil, &ratings)
+	if err != nil {
+		log.Printf("%s - could not fetch trakt ratings: %v\n", user.ProfileURL, err)
+		return
+	}
+
+	sort.SliceStable(ratings, func(i, j int) bool {
+		return ratings[i].RatedAt.Before(ratings[j].RatedAt)
+	})
+
+	handledCount := 0
+
+	for _, rating := range ratings {
+		if rating.RatedAt.Before(user.RatingsFetchedTime) {
+			continue
+		}
+
+		handled, err := a.deliverRating(user, rating)
+		if err != nil {
+			log.Printf("%s - could not send micropub: %v\n", user.ProfileURL, err)
+			return
+		}
+
+		if !handled {
+			continue
+		}
+
+		user.RatingsFetchedTime = rating.RatedAt
+
+		err = a.db.save(user)
+		if err != nil {
+			log.Printf("%s - could not save user: %v\n", user.ProfileURL, err)
+			return
+		}
+
+		handledCount++
+		if limit > 0 && handledCount >= limit {
+			return
+		}
+	}
+}
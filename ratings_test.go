@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// startImportsAt moves when the imports of ratings, the watchlist and comments
+// start from, which is otherwise when they were enabled.
+func startImportsAt(t *testing.T, a *app, u *user, at time.Time) *user {
+	stored, err := a.db.updateUser(u.ProfileURL, func(u *user) {
+		u.RatingsFetchedTime = at
+		u.WatchlistFetchedTime = at
+		u.CommentsFetchedTime = at
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return stored
+}
+
+func TestImportRatings(t *testing.T) {
+	a, mp, u := newTestApp(t, func(s *userSettings) {
+		s.ImportRatings = true
+	})
+
+	if u.RatingsFetchedTime.IsZero() {
+		t.Fatal("expected the ratings to be imported from when they were enabled")
+	}
+
+	u = startImportsAt(t, a, u, time.Now().Add(-2*time.Hour))
+
+	a.importRatings(u, 0)
+	a.importRatings(u, 0)
+
+	// Only the rating of the show is recent enough.
+	posts, _ := mp.received()
+	if len(posts) != 1 {
+		t.Fatalf("expected one rating to be posted, got %d posts", len(posts))
+	}
+
+	types, _ := posts[0]["type"].([]interface{})
+	if len(types) != 1 || types[0] != "h-review" || summary(posts[0]) != "Rated Fake Show: 9/10" {
+		t.Errorf("unexpected post %v", posts[0])
+	}
+
+	deliveries, err := a.db.getDeliveries(u.ProfileURL, ratingsKind)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(deliveries) != 1 || deliveries[0].Status != deliveryDelivered {
+		t.Errorf("expected the rating to be in the ledger, got %v", deliveries)
+	}
+}
+
+func TestImportRatingsLimit(t *testing.T) {
+	a, mp, u := newTestApp(t, func(s *userSettings) {
+		s.ImportRatings = true
+	})
+	u = startImportsAt(t, a, u, time.Now().Add(-48*time.Hour))
+
+	a.importRatings(u, 1)
+
+	posts, _ := mp.received()
+	if len(posts) != 1 || summary(posts[0]) != "Rated Fake Movie 1: 8/10" {
+		t.Fatalf("expected the oldest rating to be posted first, got %d posts", len(posts))
+	}
+
+	a.importRatings(u, 1)
+
+	posts, _ = mp.received()
+	if len(posts) != 2 {
+		t.Errorf("expected the next rating to be posted next, got %d posts", len(posts))
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"log"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// maxDeletes is how many posts deleteRemoved deletes at most in a run. Many
+// watches disappearing at once is more likely a problem with Trakt than someone
+// tidying up their history, so the rest is left for the next runs.
+const maxDeletes = 10
+
+// fetchHistory fetches every page of the history between startAt and endAt. It
+// also returns whether it got as many items as Trakt said there were: pages can
+// come back short if the history changes meanwhile, or Trakt has trouble.
+func (a *app) fetchHistory(user *user, startAt, endAt time.Time) (traktHistory, bool, error) {
+	q := url.Values{}
+	q.Set("limit", "100")
+	q.Set("start_at", startAt.Format(time.RFC3339Nano))
+	q.Set("end_at", endAt.Format(time.RFC3339Nano))
+
+	all := traktHistory{}
+
+	for page := 1; ; page++ {
+		q.Set("page", strconv.Itoa(page))
+
+		var history traktHistory
+		header, err := a.traktGet(user, "/sync/history", q, &history)
+		if err != nil {
+			return nil, false, err
+		}
+
+		all = append(all, history...)
+
+		hasNext, err := hasNextPage(header)
+		if err != nil {
+			return nil, false, err
+		}
+
+		if !hasNext {
+			itemCount, err := strconv.Atoi(header.Get("X-Pagination-Item-Count"))
+			return all, err == nil && len(all) == itemCount, nil
+		}
+	}
+}
+
+// reconcileFrom returns the time since which every item the user imported is in
+// the ledger, which is as far back as reconcileTrakt can go. Users who were
+// imported before there was a ledger may have posts before ReconcileFrom that
+// were not recorded. For everyone else, it is their oldest imported item.
+func (u *user) reconcileFrom() time.Time {
+	if u.ReconcileFrom.IsZero() {
+		// Users from before the ledger existed: items before the newest
+		// imported entry may have been posted without being recorded.
+		u.ReconcileFrom = u.NewestFetchedTime
+		u.PreLedger = true
+	}
+
+	if u.PreLedger {
+		return u.ReconcileFrom
+	}
+
+	return u.OldestFetchedTime
+}
+
+// reconcileTrakt walks the history of the last days, up to the newest imported
+// entry, and sends, in chronological order, every item that was not posted yet.
+// This catches watches that were added to Trakt in the past, as well as items
+// that were skipped because of a failure.
+func (a *app) reconcileTrakt(user *user) {
+	startAt := time.Now().AddDate(0, 0, -a.ReconcileDays)
+	if from := user.reconcileFrom(); startAt.Before(from) {
+		startAt = from
+	}
+
+	endAt := user.NewestFetchedTime
+
+	if startAt.Before(endAt) {
+		history, complete, err := a.fetchHistory(user, startAt, endAt)
+		if err != nil {
+			log.Printf("%s - could not fetch trakt: %v\n", user.ProfileURL, err)
+			return
+		}
+
+		if user.DeleteRemoved && complete && len(history) > 0 {
+			a.deleteRemoved(user, history, startAt, endAt)
+		} else if user.DeleteRemoved {
+			log.Printf("%s - not deleting removed watches: trakt returned %d items, maybe not all\n", user.ProfileURL, len(history))
+		}
+
+		sort.SliceStable(history, func(i, j int) bool {
+			return history[i].WatchedAt.Before(history[j].WatchedAt)
+		})
+
+		for _, record := range history {
+			handled, err := a.deliverHistoryItem(user, record)
+			if err != nil {
+				log.Printf("%s - could not send micropub: %v\n", user.ProfileURL, err)
+				return
+			}
+
+			if handled {
+				log.Printf("%s - backfilled %d\n", user.ProfileURL, record.ID)
+			}
+		}
+	}
+
+	user.LastReconciledAt = time.Now()
+
+	err := a.db.save(user)
+	if err != nil {
+		log.Printf("%s - could not save user: %v\n", user.ProfileURL, err)
+	}
+}
+
+// deleteRemoved deletes the posts of the items that were delivered, were watched
+// between startAt and endAt, but are no longer part of the history. At most
+// maxDeletes posts are deleted.
+func (a *app) deleteRemoved(user *user, history traktHistory, startAt, endAt time.Time) {
+	deliveries, err := a.db.getDeliveries(user.ProfileURL, historyKind)
+	if err != nil {
+		log.Printf("%s - could not get deliveries: %v\n", user.ProfileURL, err)
+		return
+	}
+
+	ids := map[string]bool{}
+	for _, record := range history {
+		ids[historyKey(record.ID)] = true
+	}
+
+	deletes := 0
+
+	for _, d := range deliveries {
+		// Leave the boundaries alone: Trakt may or may not include them.
+		if d.Status != deliveryDelivered || d.Aggregated || ids[d.Key] || !d.Date.After(startAt) || !d.Date.Before(endAt) {
+			continue
+		}
+
+		if deletes >= maxDeletes {
+			log.Printf("%s - more watches were removed from trakt, deleting them later\n", user.ProfileURL)
+			return
+		}
+
+		if d.Location == "" {
+			log.Printf("%s - %s was removed from trakt, but we do not know where it was posted\n", user.ProfileURL, d.Key)
+			continue
+		}
+
+		deletes++
+		err = a.deleteMicropub(user, d.Location)
+		if err != nil {
+			log.Printf("%s - could not delete %s: %v\n", user.ProfileURL, d.Location, err)
+			d.Error = err.Error()
+		} else {
+			log.Printf("%s - deleted %s\n", user.ProfileURL, d.Location)
+			d.Status = deliveryDeleted
+			d.Error = ""
+		}
+
+		err = a.db.saveDelivery(user.ProfileURL, d)
+		if err != nil {
+			log.Printf("%s - could not save delivery: %v\n", user.ProfileURL, err)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// addMovie adds a watch of a movie to the fake Trakt history.
+func addMovie(a *app, id int, title string, watchedAt time.Time) traktHistoryItem {
+	return a.fakeTrakt.add(traktHistoryItem{
+		Type:      "movie",
+		Action:    "watch",
+		WatchedAt: watchedAt.UTC().Truncate(time.Second),
+		Movie:     traktMovie{Title: title, Year: 2010, IDs: traktIDs{Trakt: id}},
+	})[0]
+}
+
+func TestReconcileBackfillsOlderImports(t *testing.T) {
+	a, mp, u := newTestApp(t, nil)
+
+	a.importTrakt(u, false, false, 0)
+	a.importTrakt(u, true, false, 0)
+
+	posts, _ := mp.received()
+	if len(posts) != 8 {
+		t.Fatalf("expected the seeded history to be posted, got %d posts", len(posts))
+	}
+
+	// Added to Trakt afterwards: one between the movies imported with Import
+	// Older, one older than anything that was imported.
+	backfilled := addMovie(a, 5001, "Backfilled", time.Now().Add(-36*time.Hour))
+	addMovie(a, 5002, "Too Old", time.Now().Add(-10*24*time.Hour))
+
+	a.reconcileTrakt(u)
+
+	posts, _ = mp.received()
+	if len(posts) != 9 || summary(posts[8]) != "Just watched: Backfilled" {
+		t.Fatalf("expected only the watch within the imported history to be backfilled, got %d posts", len(posts))
+	}
+
+	if d := getHistoryDelivery(t, a, u, backfilled.ID); d == nil || d.Status != deliveryDelivered {
+		t.Errorf("expected the backfilled watch to be delivered, got %+v", d)
+	}
+
+	if u.LastReconciledAt.IsZero() {
+		t.Error("expected the time of the backfill to be recorded")
+	}
+}
+
+func TestReconcilePreLedgerUser(t *testing.T) {
+	a, mp, u := newTestApp(t, nil)
+
+	// Imported before there was a ledger: older watches may have been posted.
+	u.OldestFetchedTime = time.Now().Add(-4 * 24 * time.Hour)
+	u.ReconcileFrom = time.Time{}
+
+	addMovie(a, 5001, "Maybe Posted", time.Now().Add(-20*time.Hour))
+	a.reconcileTrakt(u)
+
+	if !u.PreLedger || !u.ReconcileFrom.Equal(u.NewestFetchedTime) {
+		t.Fatalf("expected the ledger to start at the newest watch, got %v", u.ReconcileFrom)
+	}
+
+	a.importTrakt(u, false, false, 0)
+	addMovie(a, 5002, "Backfilled", time.Now().Add(-150*time.Minute))
+	a.reconcileTrakt(u)
+
+	posts, _ := mp.received()
+	if len(posts) != 6 || summary(posts[5]) != "Just watched: Backfilled" {
+		t.Errorf("expected only the watch since the ledger started to be backfilled, got %d posts", len(posts))
+	}
+}
+
+func TestReconcileDeletesRemoved(t *testing.T) {
+	a, mp, u := newTestApp(t, func(s *userSettings) {
+		s.DeleteRemoved = true
+	})
+
+	a.importTrakt(u, false, false, 0)
+	a.importTrakt(u, true, false, 0)
+
+	// Both a watch from Import Older and a regular one.
+	a.fakeTrakt.remove(2)
+	a.fakeTrakt.remove(5)
+	a.reconcileTrakt(u)
+
+	for _, id := range []int64{2, 5} {
+		if d := getHistoryDelivery(t, a, u, id); d.Status != deliveryDeleted {
+			t.Errorf("expected the post of %d to be deleted, got %+v", id, d)
+		}
+	}
+
+	posts, _ := mp.received()
+	deletes := 0
+	for _, post := range posts {
+		if post["action"] == "delete" {
+			deletes++
+		}
+	}
+
+	if deletes != 2 {
+		t.Errorf("expected 2 posts to be deleted, got %d", deletes)
+	}
+}
+
+func TestReconcileDeletesAtMostMaxDeletes(t *testing.T) {
+	a, mp, u := newTestApp(t, func(s *userSettings) {
+		s.DeleteRemoved = true
+	})
+
+	for i := 0; i < maxDeletes+5; i++ {
+		addMovie(a, 6000+i, "Movie", time.Now().Add(-11*time.Hour+time.Duration(i)*time.Minute))
+	}
+
+	a.importTrakt(u, false, false, 0)
+	for id := int64(9); id < int64(9+maxDeletes+5); id++ {
+		a.fakeTrakt.remove(id)
+	}
+
+	a.reconcileTrakt(u)
+
+	posts, _ := mp.received()
+	deletes := 0
+	for _, post := range posts {
+		if post["action"] == "delete" {
+			deletes++
+		}
+	}
+
+	if deletes != maxDeletes {
+		t.Errorf("expected %d posts to be deleted, got %d", maxDeletes, deletes)
+	}
+}
+
+func TestReconcileKeepsPostsWhenHistoryIsEmpty(t *testing.T) {
+	a, mp, u := newTestApp(t, func(s *userSettings) {
+		s.DeleteRemoved = true
+	})
+
+	a.importTrakt(u, false, false, 0)
+	for id := int64(1); id <= 8; id++ {
+		a.fakeTrakt.remove(id)
+	}
+
+	a.reconcileTrakt(u)
+
+	posts, _ := mp.received()
+	if len(posts) != 5 {
+		t.Errorf("expected nothing to be deleted, got %d requests", len(posts))
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+const (
+	backoffBase = time.Minute * 5
+	backoffMax  = time.Hour * 12
+)
+
+// conversionError is returned when an item cannot be converted into a post.
+// Retrying will not help.
+type conversionError struct {
+	err error
+}
+
+func (e *conversionError) Error() string {
+	return e.err.Error()
+}
+
+func (e *conversionError) Unwrap() error {
+	return e.err
+}
+
+// backoffDelay returns how long to wait after the given number of consecutive
+// failures, doubling the delay with each of them.
+func backoffDelay(failures int) time.Duration {
+	delay := backoffBase
+	for i := 0; i < failures && delay < backoffMax; i++ {
+		delay *= 2
+	}
+	if delay > backoffMax {
+		delay = backoffMax
+	}
+
+	return delay
+}
+
+// backoff records a transient failure and postpones the user's next import.
+func (a *app) backoff(user *user) {
+	user.RetryAt = time.Now().Add(backoffDelay(user.FailureCount))
+	user.FailureCount++
+
+	err := a.db.save(user)
+	if err != nil {
+		log.Printf("%s - could not save user: %v\n", user.ProfileURL, err)
+	}
+}
+
+func (a *app) resetBackoff(user *user) {
+	user.FailureCount = 0
+	user.RetryAt = time.Time{}
+}
+
+// retryFailed tries to send again the items that failed transiently, once their
+// backoff expired. It returns false if one of them fails again.
+func (a *app) retryFailed(user *user) bool {
+	for _, kind := range deliveryKinds {
+		deliveries, err := a.db.getDeliveries(user.ProfileURL, kind)
+		if err != nil {
+			log.Printf("%s - could not get deliveries: %v\n", user.ProfileURL, err)
+			return false
+		}
+
+		now := time.Now()
+		for _, d := range deliveries {
+			if d.Status != deliveryFailed || now.Before(d.RetryAt) {
+				continue
+			}
+
+			_, err = a.redeliver(user, d)
+			if err != nil {
+				log.Printf("%s - could not send micropub: %v\n", user.ProfileURL, err)
+				return false
+			}
+		}
+	}
+
+	err := a.db.save(user)
+	if err != nil {
+		log.Printf("%s - could not save user: %v\n", user.ProfileURL, err)
+	}
+
+	return true
+}
+
+// redeliver sends a recorded delivery again, from the item stored with it.
+func (a *app) redeliver(user *user, d *delivery) (bool, error) {
+	switch {
+	case d.Item != nil:
+		return a.deliverHistoryItem(user, *d.Item)
+	case d.Rating != nil:
+		return a.deliverRating(user, *d.Rating)
+	case d.Watchlist != nil:
+		return a.deliverWatchlistItem(user, *d.Watchlist)
+	case d.Comment != nil:
+		return a.deliverComment(user, *d.Comment)
+	default:
+		return false, nil
+	}
+}
+
+// retryJob is retryFailed as a job for the pool.
+func (a *app) retryJob(user *user) {
+	a.retryFailed(user)
+}
+
+// retryDead moves a dead letter back to the failed items, with a fresh number
+// of attempts, so that it is sent again.
+func (a *app) retryDead(user *user, kind, key string) error {
+	d, err := a.getDead(user, kind, key)
+	if err != nil {
+		return err
+	}
+
+	d.Status = deliveryFailed
+	d.Attempts = 0
+	d.RetryAt = time.Time{}
+	return a.db.saveDelivery(user.ProfileURL, d)
+}
+
+// skipDead gives up on a dead letter.
+func (a *app) skipDead(user *user, kind, key string) error {
+	d, err := a.getDead(user, kind, key)
+	if err != nil {
+		return err
+	}
+
+	d.Status = deliverySkipped
+	return a.db.saveDelivery(user.ProfileURL, d)
+}
+
+func (a *app) getDead(user *user, kind, key string) (*delivery, error) {
+	d, err := a.db.getDelivery(user.ProfileURL, kind, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if d == nil || d.Status != deliveryDead {
+		return nil, errors.New("dead letter not found")
+	}
+
+	return d, nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestIsPermanent(t *testing.T) {
+	tests := []struct {
+		err       error
+		permanent bool
+	}{
+		{&micropubError{StatusCode: http.StatusBadRequest}, true},
+		{&micropubError{StatusCode: http.StatusNotFound}, true},
+		{&micropubError{StatusCode: http.StatusUnauthorized}, false},
+		{&micropubError{StatusCode: http.StatusForbidden}, false},
+		{&micropubError{StatusCode: http.StatusRequestTimeout}, false},
+		{&micropubError{StatusCode: http.StatusTooManyRequests}, false},
+		{&micropubError{StatusCode: http.StatusBadGateway}, false},
+		{fmt.Errorf("wrapped: %w", &micropubError{StatusCode: http.StatusGone}), true},
+		{&conversionError{errors.New("no title")}, true},
+		{errors.New("connection refused"), false},
+	}
+
+	for _, test := range tests {
+		if got := isPermanent(test.err); got != test.permanent {
+			t.Errorf("%v: expected %v, got %v", test.err, test.permanent, got)
+		}
+	}
+}
+
+func TestDeliverRetriesTransientErrors(t *testing.T) {
+	a, mp, u := newTestApp(t, nil)
+	item := historyItem(t, a, 4)
+
+	mp.failNext(1, http.StatusInternalServerError, "down")
+	handled, err := a.deliverHistoryItem(u, item)
+	if handled || err == nil {
+		t.Fatal("expected the item to be retried later")
+	}
+
+	d := getHistoryDelivery(t, a, u, 4)
+	if d == nil || d.Status != deliveryFailed || d.Attempts != 1 {
+		t.Fatalf("expected the item to have failed once, got %+v", d)
+	}
+
+	if u.RetryAt.IsZero() || u.FailureCount != 1 {
+		t.Error("expected the user to back off")
+	}
+
+	handled, err = a.deliverHistoryItem(u, item)
+	if !handled || err != nil {
+		t.Fatalf("expected the item to be sent, got %v", err)
+	}
+
+	d = getHistoryDelivery(t, a, u, 4)
+	if d.Status != deliveryDelivered || d.Attempts != 2 || d.Error != "" {
+		t.Errorf("expected the item to be delivered, got %+v", d)
+	}
+
+	if !u.RetryAt.IsZero() || u.FailureCount != 0 {
+		t.Error("expected the backoff to be reset")
+	}
+}
+
+func TestDeliverGivesUp(t *testing.T) {
+	a, mp, u := newTestApp(t, nil)
+
+	// Permanent errors are not retried.
+	mp.failNext(1, http.StatusBadRequest, "invalid")
+	handled, err := a.deliverHistoryItem(u, historyItem(t, a, 4))
+	if !handled || err != nil {
+		t.Fatalf("expected the item to be handled, got %v", err)
+	}
+
+	if d := getHistoryDelivery(t, a, u, 4); d.Status != deliveryDead || d.Attempts != 1 {
+		t.Errorf("expected the item to be a dead letter, got %+v", d)
+	}
+
+	// Transient errors are, until there are no attempts left.
+	item := historyItem(t, a, 5)
+	mp.failNext(a.MaxAttempts, http.StatusBadGateway, "down")
+	for i := 1; i < a.MaxAttempts; i++ {
+		if _, err := a.deliverHistoryItem(u, item); err == nil {
+			t.Fatalf("attempt %d: expected an error", i)
+		}
+	}
+
+	handled, err = a.deliverHistoryItem(u, item)
+	if !handled || err != nil {
+		t.Fatalf("expected the item to be handled, got %v", err)
+	}
+
+	if d := getHistoryDelivery(t, a, u, 5); d.Status != deliveryDead || d.Attempts != a.MaxAttempts {
+		t.Errorf("expected the item to be a dead letter, got %+v", d)
+	}
+
+	posts, _ := mp.received()
+	if len(posts) != 0 {
+		t.Errorf("expected nothing to be posted, got %d posts", len(posts))
+	}
+}
+
+func TestDeliverUnauthorized(t *testing.T) {
+	a, mp, u := newTestApp(t, nil)
+
+	mp.failNext(1, http.StatusUnauthorized, "invalid token")
+	_, err := a.deliverHistoryItem(u, historyItem(t, a, 4))
+	if !isUnauthorized(err) {
+		t.Fatalf("expected an unauthorized error, got %v", err)
+	}
+
+	d := getHistoryDelivery(t, a, u, 4)
+	if d.Status != deliveryFailed || d.Attempts != 0 {
+		t.Errorf("expected the item to wait without using an attempt, got %+v", d)
+	}
+
+	if !u.RetryAt.IsZero() {
+		t.Error("expected the user not to back off")
+	}
+
+	stored, err := a.db.get(u.ProfileURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stored.IndieTokenError == "" {
+		t.Error("expected the user to have to reconnect")
+	}
+}
+
+func TestRetryFailed(t *testing.T) {
+	a, mp, u := newTestApp(t, nil)
+
+	mp.failNext(1, http.StatusServiceUnavailable, "down")
+	a.deliverHistoryItem(u, historyItem(t, a, 4))
+
+	d := getHistoryDelivery(t, a, u, 4)
+	if !d.RetryAt.After(time.Now()) {
+		t.Fatalf("expected the item to back off, got %v", d.RetryAt)
+	}
+
+	// Not before its backoff expires.
+	if !a.retryFailed(u) {
+		t.Fatal("expected nothing to fail")
+	}
+
+	posts, _ := mp.received()
+	if len(posts) != 0 {
+		t.Fatalf("expected the item to wait, got %d posts", len(posts))
+	}
+
+	d.RetryAt = time.Now().Add(-time.Second)
+	if err := a.db.saveDelivery(u.ProfileURL, d); err != nil {
+		t.Fatal(err)
+	}
+
+	if !a.retryFailed(u) {
+		t.Fatal("expected the failed item to be sent")
+	}
+
+	posts, _ = mp.received()
+	if len(posts) != 1 {
+		t.Errorf("expected one post, got %d", len(posts))
+	}
+
+	if d := getHistoryDelivery(t, a, u, 4); d.Status != deliveryDelivered {
+		t.Errorf("expected the item to be delivered, got %+v", d)
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	tests := []struct {
+		failures int
+		expected time.Duration
+	}{
+		{0, backoffBase},
+		{1, 2 * backoffBase},
+		{3, 8 * backoffBase},
+		{100, backoffMax},
+	}
+
+	for _, test := range tests {
+		if got := backoffDelay(test.failures); got != test.expected {
+			t.Errorf("%d failures: expected %v, got %v", test.failures, test.expected, got)
+		}
+	}
+}
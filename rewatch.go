@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// countPlays returns how many times the user watched the movie or episode, up
+// to and including the given watch, according to their Trakt history.
+func (a *app) countPlays(user *user, item traktHistoryItem) (int, error) {
+	var path string
+	switch item.Type {
+	case "movie":
+		path = "/sync/history/movies/" + strconv.Itoa(item.Movie.IDs.Trakt)
+	case "episode":
+		path = "/sync/history/episodes/" + strconv.Itoa(item.Episode.IDs.Trakt)
+	default:
+		return 0, nil
+	}
+
+	q := url.Values{}
+	q.Set("limit", "1")
+	q.Set("end_at", item.WatchedAt.Format(time.RFC3339Nano))
+
+	// Only the total count matters, which Trakt gives in the headers.
+	var history traktHistory
+	header, err := a.traktGet(user, path, q, &history)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(header.Get("X-Pagination-Item-Count"))
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOrdinal(t *testing.T) {
+	tests := map[int]string{
+		1:   "1st",
+		2:   "2nd",
+		3:   "3rd",
+		4:   "4th",
+		11:  "11th",
+		12:  "12th",
+		13:  "13th",
+		21:  "21st",
+		102: "102nd",
+		111: "111th",
+	}
+
+	for n, expected := range tests {
+		if got := ordinal(n); got != expected {
+			t.Errorf("%d: expected %s, got %s", n, expected, got)
+		}
+	}
+}
+
+func TestRewatch(t *testing.T) {
+	a, mp, u := newTestApp(t, nil)
+
+	movie := historyItem(t, a, 1)
+	for _, ago := range []time.Duration{90 * time.Minute, 30 * time.Minute} {
+		rewatch := movie
+		rewatch.ID = 0
+		rewatch.WatchedAt = time.Now().Add(-ago).UTC().Truncate(time.Second)
+		a.fakeTrakt.add(rewatch)
+	}
+
+	plays, err := a.countPlays(u, movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if plays != 1 {
+		t.Errorf("expected the first watch to be the first play, got %d", plays)
+	}
+
+	a.importTrakt(u, false, false, 0)
+
+	posts, _ := mp.received()
+	bySummary := map[string]map[string]interface{}{}
+	for _, post := range posts {
+		bySummary[summary(post)] = post
+	}
+
+	tests := []struct {
+		summary string
+		count   float64
+		rewatch bool
+	}{
+		{"Just watched: Episode 1 (Fake Show S1E1)", 1, false},
+		{"Rewatched: Fake Movie 1 (2nd time)", 2, true},
+		{"Rewatched: Fake Movie 1 (3rd time)", 3, true},
+	}
+
+	for _, test := range tests {
+		post, ok := bySummary[test.summary]
+		if !ok {
+			t.Errorf("expected a post %q", test.summary)
+			continue
+		}
+
+		count := property(post, "watch-count")
+		rewatch := property(post, "rewatch")
+		if len(count) != 1 || count[0] != test.count || len(rewatch) != 1 || rewatch[0] != test.rewatch {
+			t.Errorf("%s: expected a count of %v, got %v and %v", test.summary, test.count, count, rewatch)
+		}
+	}
+}
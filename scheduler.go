@@ -0,0 +1,223 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+type scheduleItem struct {
+	profileURL string
+	at         time.Time
+	index      int
+}
+
+// scheduleQueue is a priority queue of users, ordered by their next run.
+type scheduleQueue []*scheduleItem
+
+func (q scheduleQueue) Len() int           { return len(q) }
+func (q scheduleQueue) Less(i, j int) bool { return q[i].at.Before(q[j].at) }
+
+func (q scheduleQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *scheduleQueue) Push(x interface{}) {
+	item := x.(*scheduleItem)
+	item.index = len(*q)
+	*q = append(*q, item)
+}
+
+func (q *scheduleQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return item
+}
+
+// scheduler keeps track of when each user must be imported next.
+type scheduler struct {
+	mu    sync.Mutex
+	queue scheduleQueue
+	items map[string]*scheduleItem
+	wake  chan struct{}
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{
+		items: map[string]*scheduleItem{},
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+// schedule sets when the user must be imported next, replacing what was set.
+func (s *scheduler) schedule(profileURL string, at time.Time) {
+	s.mu.Lock()
+	if item, ok := s.items[profileURL]; ok {
+		item.at = at
+		heap.Fix(&s.queue, item.index)
+	} else {
+		item = &scheduleItem{profileURL: profileURL, at: at}
+		s.items[profileURL] = item
+		heap.Push(&s.queue, item)
+	}
+	s.mu.Unlock()
+
+	s.notify()
+}
+
+func (s *scheduler) remove(profileURL string) {
+	s.mu.Lock()
+	if item, ok := s.items[profileURL]; ok {
+		heap.Remove(&s.queue, item.index)
+		delete(s.items, profileURL)
+	}
+	s.mu.Unlock()
+
+	s.notify()
+}
+
+func (s *scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// due removes and returns the users whose time has come, as well as the time
+// at which the next user is due, or zero if there is none.
+func (s *scheduler) due(now time.Time) ([]string, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	profileURLs := []string{}
+	for len(s.queue) > 0 && !s.queue[0].at.After(now) {
+		item := heap.Pop(&s.queue).(*scheduleItem)
+		delete(s.items, item.profileURL)
+		profileURLs = append(profileURLs, item.profileURL)
+	}
+
+	if len(s.queue) == 0 {
+		return profileURLs, time.Time{}
+	}
+
+	return profileURLs, s.queue[0].at
+}
+
+// importInterval returns the user's import interval within the configured bounds.
+func (a *app) importInterval(user *user) time.Duration {
+	interval := user.ImportInterval
+	if interval == 0 {
+		interval = a.DefaultInterval
+	}
+
+	if interval < a.MinInterval {
+		interval = a.MinInterval
+	}
+
+	if interval > a.MaxInterval {
+		interval = a.MaxInterval
+	}
+
+	return interval
+}
+
+// scheduleUser adds the user to the schedule, at their next run, or removes
+// them if they are paused.
+func (a *app) scheduleUser(user *user) {
+	if user.Paused {
+		a.scheduler.remove(user.ProfileURL)
+		return
+	}
+
+	a.scheduler.schedule(user.ProfileURL, user.NextRunAt)
+}
+
+// runScheduled queues the import of the user, if possible, and schedules the
+// next one.
+func (a *app) runScheduled(profileURL string) {
+	user, err := a.db.get(profileURL)
+	if err != nil {
+		log.Printf("%s - could not get user: %v\n", profileURL, err)
+		return
+	}
+
+	if user.Paused {
+		return
+	}
+
+	now := time.Now()
+	user.NextRunAt = now.Add(a.importInterval(user))
+
+	canImport := user.IndieToken != nil && user.TraktToken != nil &&
+		// Otherwise, requires user action: they need to reconnect.
+		user.IndieTokenError == "" && user.TraktTokenError == ""
+
+	if canImport && now.Before(user.RetryAt) {
+		// Backing off, try again as soon as possible.
+		canImport = false
+		if user.RetryAt.Before(user.NextRunAt) {
+			user.NextRunAt = user.RetryAt
+		}
+	}
+
+	// Only the next run is ours to change: a job may be saving the rest.
+	err = a.db.setNextRunAt(profileURL, user.NextRunAt)
+	if err != nil {
+		log.Printf("%s - could not save user: %v\n", profileURL, err)
+	}
+
+	a.scheduleUser(user)
+
+	if canImport {
+		a.submit(profileURL, a.importCycle)
+	}
+}
+
+// scheduleImports runs the imports of each user when they are due, until the
+// context is done.
+func (a *app) scheduleImports(ctx context.Context) {
+	users, err := a.db.getAll()
+	if err != nil {
+		log.Printf("error while getting users: %v\n", err)
+	}
+
+	for _, user := range users {
+		a.scheduleUser(user)
+	}
+
+	for {
+		profileURLs, next := a.scheduler.due(time.Now())
+		for _, profileURL := range profileURLs {
+			a.runScheduled(profileURL)
+		}
+
+		// Without anyone scheduled, wait until someone is.
+		var timer *time.Timer
+		var fire <-chan time.Time
+		if !next.IsZero() {
+			timer = time.NewTimer(time.Until(next))
+			fire = timer.C
+		}
+
+		select {
+		case <-fire:
+		case <-a.scheduler.wake:
+		case <-ctx.Done():
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSchedulerDue(t *testing.T) {
+	s := newScheduler()
+	now := time.Now()
+
+	s.schedule("c", now.Add(3*time.Minute))
+	s.schedule("a", now.Add(-2*time.Minute))
+	s.schedule("b", now.Add(-time.Minute))
+	s.schedule("d", now.Add(4*time.Minute))
+
+	due, next := s.due(now)
+	if !reflect.DeepEqual(due, []string{"a", "b"}) {
+		t.Errorf("expected a and b to be due, in order, got %v", due)
+	}
+
+	if !next.Equal(now.Add(3 * time.Minute)) {
+		t.Errorf("expected c to be next, got %v", next)
+	}
+
+	// Due users are removed.
+	due, _ = s.due(now)
+	if len(due) != 0 {
+		t.Errorf("expected no user to be due, got %v", due)
+	}
+}
+
+func TestSchedulerReschedule(t *testing.T) {
+	s := newScheduler()
+	now := time.Now()
+
+	s.schedule("a", now.Add(time.Minute))
+	s.schedule("b", now.Add(2*time.Minute))
+	s.schedule("b", now.Add(-time.Minute))
+	s.remove("a")
+
+	due, next := s.due(now)
+	if !reflect.DeepEqual(due, []string{"b"}) {
+		t.Errorf("expected only b to be due, got %v", due)
+	}
+
+	if !next.IsZero() {
+		t.Errorf("expected nothing else to be scheduled, got %v", next)
+	}
+}
+
+func TestImportInterval(t *testing.T) {
+	a := &app{config: &config{
+		DefaultInterval: 30 * time.Minute,
+		MinInterval:     10 * time.Minute,
+		MaxInterval:     24 * time.Hour,
+	}}
+
+	tests := []struct {
+		interval time.Duration
+		expected time.Duration
+	}{
+		{0, 30 * time.Minute},
+		{time.Minute, 10 * time.Minute},
+		{time.Hour, time.Hour},
+		{48 * time.Hour, 24 * time.Hour},
+	}
+
+	for _, test := range tests {
+		u := &user{}
+		u.ImportInterval = test.interval
+
+		if got := a.importInterval(u); got != test.expected {
+			t.Errorf("interval %v: expected %v, got %v", test.interval, test.expected, got)
+		}
+	}
+}
+
+func TestScheduleSurvivesRunningJobs(t *testing.T) {
+	a, _, u := newTestApp(t, nil)
+
+	// The user changes their schedule while an import is running.
+	next := time.Now().Add(time.Hour).Round(time.Second)
+	_, err := a.db.updateSettings(u.ProfileURL, func(s *userSettings) {
+		s.ImportInterval = time.Hour
+		s.Paused = true
+		s.NextRunAt = next
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.importTrakt(u, false, false, 0)
+
+	stored, err := a.db.get(u.ProfileURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stored.ImportInterval != time.Hour || !stored.Paused || !stored.NextRunAt.Equal(next) {
+		t.Errorf("expected the schedule to be kept, got %v, %v, %v", stored.ImportInterval, stored.Paused, stored.NextRunAt)
+	}
+
+	// Saving got the import the latest settings, so it stopped once paused.
+	if stored.NewestFetchedID != 4 {
+		t.Errorf("expected the import to stop after the first item, got %d", stored.NewestFetchedID)
+	}
+}
@@ -3,10 +3,13 @@ package main
 import (
 	"embed"
 	"errors"
+	"html/template"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
@@ -38,6 +41,10 @@ func newServer(app *app) (*server, error) {
 			Layout:     "layout",
 			Directory:  "templates",
 			FileSystem: render.FS(templates),
+			Funcs: []template.FuncMap{{
+				"contains": contains,
+				"inc":      inc,
+			}},
 		}),
 	}
 
@@ -62,6 +69,29 @@ func (s *server) start() error {
 
 	r.Get("/trakt/newer", s.traktNewerGet)
 	r.Get("/trakt/older", s.traktOlderGet)
+	r.Get("/trakt/reconcile", s.traktReconcileGet)
+	r.Get("/trakt/preview", s.traktPreviewGet)
+	r.Get("/trakt/preview.json", s.traktPreviewJSONGet)
+	r.Post("/trakt/everything", s.traktEverythingPost)
+	r.Post("/trakt/everything/cancel", s.traktEverythingCancelPost)
+
+	r.Post("/settings", s.settingsPost)
+	r.Get("/settings/templates", s.templatesGet)
+	r.Post("/settings/micropub", s.settingsMicropubPost)
+	r.Post("/micropub/config", s.micropubConfigPost)
+	r.Post("/settings/templates", s.templatesPost)
+	r.Get("/settings/filters", s.filtersGet)
+	r.Post("/settings/filters", s.filtersPost)
+	r.Post("/schedule", s.schedulePost)
+	r.Post("/schedule/pause", s.schedulePausePost)
+	r.Post("/schedule/resume", s.scheduleResumePost)
+	r.Get("/log", s.logGet)
+	r.Post("/log/retry", s.logRetryPost)
+	r.Post("/log/skip", s.logSkipPost)
+
+	if s.fakeTrakt != nil {
+		r.Mount(fakeTraktPrefix, s.fakeTrakt)
+	}
 
 	addr := ":" + strconv.Itoa(s.Port)
 	ln, err := net.Listen("tcp", addr)
@@ -81,8 +111,14 @@ func (s *server) start() error {
 }
 
 type rootData struct {
-	Importing bool
-	User      *user
+	Importing   bool
+	User        *user
+	Interval    int
+	MinInterval int
+	MaxInterval int
+	HasTMDb     bool
+	// MaxPostsPerHour bounds the speed of bulk imports.
+	MaxPostsPerHour int
 }
 
 func (s *server) rootGet(w http.ResponseWriter, r *http.Request) {
@@ -91,18 +127,21 @@ func (s *server) rootGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	importing := false
+	data := &rootData{
+		User:        user,
+		MinInterval: int(s.MinInterval.Minutes()),
+		MaxInterval: int(s.MaxInterval.Minutes()),
+		HasTMDb:     s.TMDbAPIKey != "",
+
+		MaxPostsPerHour: s.MaxPostsPerHour,
+	}
 
 	if user != nil {
-		s.importMu.Lock()
-		importing = s.importing[user.ProfileURL]
-		s.importMu.Unlock()
+		data.Importing = s.isImporting(user)
+		data.Interval = int(s.importInterval(user).Minutes())
 	}
 
-	err := s.render.HTML(w, http.StatusOK, "home", &rootData{
-		User:      user,
-		Importing: importing,
-	})
+	err := s.render.HTML(w, http.StatusOK, "home", data)
 	if err != nil {
 		log.Print(err)
 	}
@@ -163,6 +202,7 @@ func (s *server) loginGet(w http.ResponseWriter, r *http.Request) {
 			OldestFetchedTime: time.Now(),
 		}
 		u.NewestFetchedTime = u.OldestFetchedTime
+		u.ReconcileFrom = u.OldestFetchedTime
 	}
 
 	err = s.db.save(u)
@@ -170,6 +210,7 @@ func (s *server) loginGet(w http.ResponseWriter, r *http.Request) {
 		s.error(w, r, nil, http.StatusInternalServerError, err)
 		return
 	}
+	s.scheduleUser(u)
 
 	http.Redirect(w, r, redirect, http.StatusSeeOther)
 }
@@ -226,13 +267,20 @@ func (s *server) callbackGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user.IndieToken = tok
+	user.userTokens, err = s.db.updateTokens(user.ProfileURL, func(t *userTokens) {
+		t.IndieToken = tok
+		t.IndieTokenError = ""
+	})
+	if err != nil {
+		s.error(w, r, nil, http.StatusInternalServerError, err)
+		return
+	}
 	session.Values["me"] = user.ProfileURL
 
-	err = s.db.save(user)
+	err = s.refreshMicropubConfig(user)
 	if err != nil {
-		s.error(w, r, user, http.StatusInternalServerError, err)
-		return
+		// Not all endpoints support it. It can be fetched again later on.
+		log.Printf("%s - could not get micropub config: %v\n", user.ProfileURL, err)
 	}
 
 	delete(session.Values, "auth_me")
@@ -315,13 +363,22 @@ func (s *server) traktCallbackGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user.TraktToken = tok
+	user.userTokens, err = s.db.updateTokens(user.ProfileURL, func(t *userTokens) {
+		t.TraktToken = tok
+		t.TraktTokenError = ""
+	})
+	if err != nil {
+		s.error(w, r, user, http.StatusInternalServerError, err)
+		return
+	}
 
-	err = s.db.save(user)
+	user.NextRunAt = time.Now()
+	err = s.db.setNextRunAt(user.ProfileURL, user.NextRunAt)
 	if err != nil {
 		s.error(w, r, user, http.StatusInternalServerError, err)
 		return
 	}
+	s.scheduleUser(user)
 
 	delete(session.Values, "trakt_state")
 
@@ -361,6 +418,498 @@ func (s *server) traktResetPost(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
+const logPerPage = 50
+
+type logData struct {
+	User       *user
+	Deliveries []*delivery
+	Kind       string
+	Status     deliveryStatus
+	Page       int
+	PrevPage   int
+	NextPage   int
+	Total      int
+}
+
+func (s *server) logGet(w http.ResponseWriter, r *http.Request) {
+	user, _ := s.mustUser(w, r)
+	if user == nil {
+		return
+	}
+
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	kind := r.URL.Query().Get("kind")
+	if kind != ratingsKind && kind != watchlistKind && kind != commentsKind && kind != watchingKind {
+		kind = historyKind
+	}
+
+	status := deliveryStatus(r.URL.Query().Get("status"))
+
+	deliveries, total, err := s.db.getRecentDeliveries(user.ProfileURL, kind, status, page, logPerPage)
+	if err != nil {
+		s.error(w, r, user, http.StatusInternalServerError, err)
+		return
+	}
+
+	data := &logData{
+		User:       user,
+		Deliveries: deliveries,
+		Kind:       kind,
+		Status:     status,
+		Page:       page,
+		Total:      total,
+	}
+
+	if page > 1 {
+		data.PrevPage = page - 1
+	}
+
+	if page*logPerPage < total {
+		data.NextPage = page + 1
+	}
+
+	err = s.render.HTML(w, http.StatusOK, "log", data)
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+func (s *server) logRetryPost(w http.ResponseWriter, r *http.Request) {
+	user, _ := s.mustUser(w, r)
+	if user == nil {
+		return
+	}
+
+	kind := r.FormValue("kind")
+
+	err := s.retryDead(user, kind, r.FormValue("key"))
+	if err != nil {
+		s.error(w, r, user, http.StatusBadRequest, err)
+		return
+	}
+
+	s.submit(user.ProfileURL, s.retryJob)
+
+	http.Redirect(w, r, "/log?kind="+url.QueryEscape(kind)+"&status="+string(deliveryDead), http.StatusSeeOther)
+}
+
+func (s *server) logSkipPost(w http.ResponseWriter, r *http.Request) {
+	user, _ := s.mustUser(w, r)
+	if user == nil {
+		return
+	}
+
+	kind := r.FormValue("kind")
+
+	err := s.skipDead(user, kind, r.FormValue("key"))
+	if err != nil {
+		s.error(w, r, user, http.StatusBadRequest, err)
+		return
+	}
+
+	http.Redirect(w, r, "/log?kind="+url.QueryEscape(kind)+"&status="+string(deliveryDead), http.StatusSeeOther)
+}
+
+func (s *server) settingsPost(w http.ResponseWriter, r *http.Request) {
+	user, _ := s.mustUser(w, r)
+	if user == nil {
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		s.error(w, r, user, http.StatusBadRequest, err)
+		return
+	}
+
+	// Like the history, ratings, the watchlist and comments are only imported from
+	// when they are enabled.
+	_, err = s.db.updateSettings(user.ProfileURL, func(settings *userSettings) {
+		settings.DeleteRemoved = r.Form.Get("deleteRemoved") == "on"
+		settings.ImportRatings = r.Form.Get("importRatings") == "on"
+		settings.ImportWatchlist = r.Form.Get("importWatchlist") == "on"
+		settings.ImportComments = r.Form.Get("importComments") == "on"
+		settings.LiveWatching = r.Form.Get("liveWatching") == "on"
+		settings.AggregateBinges = r.Form.Get("aggregateBinges") == "on"
+		settings.EnrichMetadata = r.Form.Get("enrichMetadata") == "on"
+		settings.UploadPhotos = r.Form.Get("uploadPhotos") == "on"
+	})
+	if err != nil {
+		s.error(w, r, user, http.StatusInternalServerError, err)
+		return
+	}
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+var (
+	postStatuses = []string{"", "published", "draft"}
+	visibilities = []string{"", "public", "unlisted", "private"}
+)
+
+func (s *server) settingsMicropubPost(w http.ResponseWriter, r *http.Request) {
+	user, _ := s.mustUser(w, r)
+	if user == nil {
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		s.error(w, r, user, http.StatusBadRequest, err)
+		return
+	}
+
+	syndicateTo := []string{}
+	for _, uid := range r.Form["syndicateTo"] {
+		if user.MicropubConfig == nil || !user.MicropubConfig.hasTarget(uid) {
+			s.error(w, r, user, http.StatusBadRequest, errors.New("unknown syndication target "+uid))
+			return
+		}
+		syndicateTo = append(syndicateTo, uid)
+	}
+
+	postStatus := r.Form.Get("postStatus")
+	if !contains(postStatuses, postStatus) {
+		s.error(w, r, user, http.StatusBadRequest, errors.New("invalid post status "+postStatus))
+		return
+	}
+
+	visibility := r.Form.Get("visibility")
+	if !contains(visibilities, visibility) {
+		s.error(w, r, user, http.StatusBadRequest, errors.New("invalid visibility "+visibility))
+		return
+	}
+
+	movieRule, err := parsePostRule(r, "movie")
+	if err != nil {
+		s.error(w, r, user, http.StatusBadRequest, err)
+		return
+	}
+
+	episodeRule, err := parsePostRule(r, "episode")
+	if err != nil {
+		s.error(w, r, user, http.StatusBadRequest, err)
+		return
+	}
+
+	micropubMode := r.Form.Get("micropubMode")
+	if !contains(micropubModes, micropubMode) {
+		s.error(w, r, user, http.StatusBadRequest, errors.New("invalid micropub mode "+micropubMode))
+		return
+	}
+
+	_, err = s.db.updateSettings(user.ProfileURL, func(settings *userSettings) {
+		settings.SyndicateTo = syndicateTo
+		settings.PostStatus = postStatus
+		settings.Visibility = visibility
+		settings.PostRules = postRules{Movie: movieRule, Episode: episodeRule}
+		if micropubMode != settings.MicropubMode {
+			// Start over, e.g., to detect it again when going back to automatic.
+			settings.DetectedMicropubMode = ""
+		}
+		settings.MicropubMode = micropubMode
+	})
+	if err != nil {
+		s.error(w, r, user, http.StatusInternalServerError, err)
+		return
+	}
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// parsePostRule reads the post rule for the given type from the form.
+func parsePostRule(r *http.Request, itemType string) (postRule, error) {
+	rule := postRule{
+		PostStatus: r.Form.Get(itemType + "PostStatus"),
+		Visibility: r.Form.Get(itemType + "Visibility"),
+	}
+
+	if !contains(postStatuses, rule.PostStatus) {
+		return rule, errors.New("invalid post status " + rule.PostStatus)
+	}
+
+	if !contains(visibilities, rule.Visibility) {
+		return rule, errors.New("invalid visibility " + rule.Visibility)
+	}
+
+	return rule, nil
+}
+
+func (s *server) micropubConfigPost(w http.ResponseWriter, r *http.Request) {
+	user, _ := s.mustUser(w, r)
+	if user == nil {
+		return
+	}
+
+	err := s.refreshMicropubConfig(user)
+	if err != nil {
+		s.error(w, r, user, http.StatusBadGateway, err)
+		return
+	}
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+type templatesData struct {
+	User      *user
+	Templates postTemplates
+	Previews  []templatePreview
+	Error     string
+}
+
+type templatePreview struct {
+	Type string
+	JSON string
+}
+
+// newTemplatesData previews the templates with sample watches. If they are not
+// valid, Error says why.
+func newTemplatesData(user *user, tmpls postTemplates) *templatesData {
+	data := &templatesData{
+		User:      user,
+		Templates: tmpls,
+	}
+
+	for _, itemType := range []string{"movie", "episode"} {
+		preview, err := previewPost(tmpls, itemType)
+		if err != nil {
+			data.Error = itemType + ": " + err.Error()
+			continue
+		}
+
+		data.Previews = append(data.Previews, templatePreview{Type: itemType, JSON: preview})
+	}
+
+	return data
+}
+
+func (s *server) templatesGet(w http.ResponseWriter, r *http.Request) {
+	user, _ := s.mustUser(w, r)
+	if user == nil {
+		return
+	}
+
+	err := s.render.HTML(w, http.StatusOK, "posttemplates", newTemplatesData(user, user.Templates))
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+func (s *server) templatesPost(w http.ResponseWriter, r *http.Request) {
+	user, _ := s.mustUser(w, r)
+	if user == nil {
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		s.error(w, r, user, http.StatusBadRequest, err)
+		return
+	}
+
+	tmpls := postTemplates{
+		Movie: postTemplate{
+			Summary: r.Form.Get("movieSummary"),
+			Content: r.Form.Get("movieContent"),
+			Name:    r.Form.Get("movieName"),
+		},
+		Episode: postTemplate{
+			Summary: r.Form.Get("episodeSummary"),
+			Content: r.Form.Get("episodeContent"),
+			Name:    r.Form.Get("episodeName"),
+		},
+	}
+
+	data := newTemplatesData(user, tmpls)
+	code := http.StatusOK
+
+	if r.Form.Get("action") == "save" {
+		if data.Error == "" {
+			_, err = s.db.updateSettings(user.ProfileURL, func(settings *userSettings) {
+				settings.Templates = tmpls
+			})
+			if err != nil {
+				s.error(w, r, user, http.StatusInternalServerError, err)
+				return
+			}
+
+			http.Redirect(w, r, "/settings/templates", http.StatusSeeOther)
+			return
+		}
+
+		code = http.StatusBadRequest
+	}
+
+	err = s.render.HTML(w, code, "posttemplates", data)
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+type filtersData struct {
+	User  *user
+	Error string
+}
+
+func (s *server) filtersGet(w http.ResponseWriter, r *http.Request) {
+	user, _ := s.mustUser(w, r)
+	if user == nil {
+		return
+	}
+
+	err := s.render.HTML(w, http.StatusOK, "filters", &filtersData{User: user})
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+// filtersPost adds or deletes a rule, or changes the timezone of the rules,
+// depending on the action.
+func (s *server) filtersPost(w http.ResponseWriter, r *http.Request) {
+	user, _ := s.mustUser(w, r)
+	if user == nil {
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		s.error(w, r, user, http.StatusBadRequest, err)
+		return
+	}
+
+	switch r.Form.Get("action") {
+	case "add":
+		rule := filterRule{
+			Exclude: r.Form.Get("exclude") == "true",
+			Type:    r.Form.Get("type"),
+			Show:    strings.TrimSpace(r.Form.Get("show")),
+			Genre:   strings.TrimSpace(r.Form.Get("genre")),
+			From:    r.Form.Get("from"),
+			To:      r.Form.Get("to"),
+		}
+
+		if minutes := r.Form.Get("minRuntime"); minutes != "" {
+			rule.MinRuntime, err = strconv.Atoi(minutes)
+			if err != nil {
+				s.renderFilters(w, user, err)
+				return
+			}
+		}
+
+		err = rule.validate()
+		if err != nil {
+			s.renderFilters(w, user, err)
+			return
+		}
+
+		user.Filters = append(user.Filters, rule)
+	case "delete":
+		i, err := strconv.Atoi(r.Form.Get("index"))
+		if err != nil || i < 0 || i >= len(user.Filters) {
+			s.error(w, r, user, http.StatusBadRequest, errors.New("rule not found"))
+			return
+		}
+
+		user.Filters = append(user.Filters[:i], user.Filters[i+1:]...)
+	case "timezone":
+		timezone := strings.TrimSpace(r.Form.Get("timezone"))
+		_, err = time.LoadLocation(timezone)
+		if err != nil {
+			s.renderFilters(w, user, err)
+			return
+		}
+
+		user.Timezone = timezone
+	default:
+		s.error(w, r, user, http.StatusBadRequest, errors.New("unknown action"))
+		return
+	}
+
+	_, err = s.db.updateSettings(user.ProfileURL, func(settings *userSettings) {
+		settings.Filters = user.Filters
+		settings.Timezone = user.Timezone
+	})
+	if err != nil {
+		s.error(w, r, user, http.StatusInternalServerError, err)
+		return
+	}
+
+	http.Redirect(w, r, "/settings/filters", http.StatusSeeOther)
+}
+
+func (s *server) renderFilters(w http.ResponseWriter, user *user, err error) {
+	err = s.render.HTML(w, http.StatusBadRequest, "filters", &filtersData{User: user, Error: err.Error()})
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+func (s *server) schedulePost(w http.ResponseWriter, r *http.Request) {
+	user, _ := s.mustUser(w, r)
+	if user == nil {
+		return
+	}
+
+	minutes, err := strconv.Atoi(r.FormValue("interval"))
+	if err != nil {
+		s.error(w, r, user, http.StatusBadRequest, err)
+		return
+	}
+
+	interval := time.Duration(minutes) * time.Minute
+	if interval < s.MinInterval || interval > s.MaxInterval {
+		s.error(w, r, user, http.StatusBadRequest, errors.New("interval is out of bounds"))
+		return
+	}
+
+	user.ImportInterval = interval
+	if next := time.Now().Add(interval); next.Before(user.NextRunAt) {
+		user.NextRunAt = next
+	}
+
+	s.saveSchedule(w, r, user)
+}
+
+func (s *server) schedulePausePost(w http.ResponseWriter, r *http.Request) {
+	user, _ := s.mustUser(w, r)
+	if user == nil {
+		return
+	}
+
+	user.Paused = true
+	s.saveSchedule(w, r, user)
+}
+
+func (s *server) scheduleResumePost(w http.ResponseWriter, r *http.Request) {
+	user, _ := s.mustUser(w, r)
+	if user == nil {
+		return
+	}
+
+	user.Paused = false
+	user.NextRunAt = time.Now()
+	s.saveSchedule(w, r, user)
+}
+
+func (s *server) saveSchedule(w http.ResponseWriter, r *http.Request, user *user) {
+	_, err := s.db.updateSettings(user.ProfileURL, func(settings *userSettings) {
+		settings.ImportInterval = user.ImportInterval
+		settings.Paused = user.Paused
+		settings.NextRunAt = user.NextRunAt
+	})
+	if err != nil {
+		s.error(w, r, user, http.StatusInternalServerError, err)
+		return
+	}
+
+	s.scheduleUser(user)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
 func (s *server) error(w http.ResponseWriter, r *http.Request, user *user, code int, err error) {
 	if user == nil {
 		log.Println(err)
@@ -426,34 +975,159 @@ func (s *server) checkTrakt(w http.ResponseWriter, r *http.Request) (user *user,
 		return nil, false
 	}
 
-	s.importMu.Lock()
-	defer s.importMu.Unlock()
-	running := s.importing[user.ProfileURL]
+	return user, true
+}
 
-	if running {
-		// Already being imported... just redirect!
-		http.Redirect(w, r, "/", http.StatusSeeOther)
-		return nil, false
+// submitImport queues the import job for the user and redirects home. If there
+// is already a job for the user, nothing is queued.
+func (s *server) submitImport(w http.ResponseWriter, r *http.Request, fn func(user *user)) {
+	user, ok := s.checkTrakt(w, r)
+	if !ok {
+		return
 	}
 
+	s.submit(user.ProfileURL, fn)
 	http.Redirect(w, r, "/", http.StatusSeeOther)
-	return user, true
 }
 
 func (s *server) traktNewerGet(w http.ResponseWriter, r *http.Request) {
+	s.submitImport(w, r, func(user *user) {
+		s.importTrakt(user, false, false, 0)
+	})
+}
+
+func (s *server) traktOlderGet(w http.ResponseWriter, r *http.Request) {
+	s.submitImport(w, r, func(user *user) {
+		s.importTrakt(user, true, false, 0)
+	})
+}
+
+func (s *server) traktReconcileGet(w http.ResponseWriter, r *http.Request) {
+	s.submitImport(w, r, s.reconcileTrakt)
+}
+
+func (s *server) traktEverythingPost(w http.ResponseWriter, r *http.Request) {
 	user, ok := s.checkTrakt(w, r)
 	if !ok {
 		return
 	}
 
-	go s.importTrakt(user, false, false)
+	perHour, err := strconv.Atoi(r.FormValue("perHour"))
+	if err != nil {
+		s.error(w, r, user, http.StatusBadRequest, err)
+		return
+	}
+
+	if perHour < 1 || perHour > s.MaxPostsPerHour {
+		s.error(w, r, user, http.StatusBadRequest, errors.New("posts per hour must be between 1 and "+strconv.Itoa(s.MaxPostsPerHour)))
+		return
+	}
+
+	err = s.startBulkImport(user, perHour)
+	if err != nil {
+		s.error(w, r, user, http.StatusInternalServerError, err)
+		return
+	}
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
-func (s *server) traktOlderGet(w http.ResponseWriter, r *http.Request) {
+func (s *server) traktEverythingCancelPost(w http.ResponseWriter, r *http.Request) {
+	user, _ := s.mustUser(w, r)
+	if user == nil {
+		return
+	}
+
+	err := s.db.setBulkImport(user.ProfileURL, nil)
+	if err != nil {
+		s.error(w, r, user, http.StatusInternalServerError, err)
+		return
+	}
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+type previewData struct {
+	User      *user
+	Direction string
+	Items     []previewItem
+	Limit     int
+	MadeAt    time.Time
+	// Pending is set while the preview is being made.
+	Pending bool
+}
+
+// preview returns the dry run of the import in the direction of the request,
+// which is newer unless it says older. It is made in the background, as it can
+// take a while.
+func (s *server) preview(w http.ResponseWriter, r *http.Request) (*previewData, bool) {
 	user, ok := s.checkTrakt(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	direction := "newer"
+	if r.URL.Query().Get("direction") == "older" {
+		direction = "older"
+	}
+
+	data := &previewData{
+		User:      user,
+		Direction: direction,
+		Limit:     previewLimit,
+	}
+
+	result := s.getPreview(user.ProfileURL, direction == "older")
+	if result == nil {
+		data.Pending = true
+		return data, true
+	}
+
+	if result.Error != "" {
+		s.error(w, r, user, http.StatusBadGateway, errors.New(result.Error))
+		return nil, false
+	}
+
+	data.Items = result.Items
+	data.MadeAt = result.MadeAt
+	return data, true
+}
+
+func (s *server) traktPreviewGet(w http.ResponseWriter, r *http.Request) {
+	data, ok := s.preview(w, r)
+	if !ok {
+		return
+	}
+
+	err := s.render.HTML(w, http.StatusOK, "preview", data)
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+func (s *server) traktPreviewJSONGet(w http.ResponseWriter, r *http.Request) {
+	data, ok := s.preview(w, r)
 	if !ok {
 		return
 	}
 
-	go s.importTrakt(user, true, false)
+	if data.Pending {
+		err := s.render.JSON(w, http.StatusAccepted, map[string]interface{}{
+			"direction": data.Direction,
+			"pending":   true,
+		})
+		if err != nil {
+			log.Print(err)
+		}
+		return
+	}
+
+	err := s.render.JSON(w, http.StatusOK, map[string]interface{}{
+		"direction": data.Direction,
+		"items":     data.Items,
+		"madeAt":    data.MadeAt,
+	})
+	if err != nil {
+		log.Print(err)
+	}
 }
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"golang.org/x/oauth2"
+)
+
+// persistingTokenSource wraps a token source and calls onRefresh every time
+// the underlying source hands out a different token than the one we know of,
+// so that rotated tokens can be stored. If the refresh fails permanently,
+// onFailure is called instead.
+type persistingTokenSource struct {
+	mu        sync.Mutex
+	src       oauth2.TokenSource
+	current   *oauth2.Token
+	onRefresh func(*oauth2.Token)
+	onFailure func(error)
+}
+
+func (p *persistingTokenSource) Token() (*oauth2.Token, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	tok, err := p.src.Token()
+	if err != nil {
+		if isPermanentTokenError(err, p.current) {
+			p.onFailure(err)
+		}
+		return nil, err
+	}
+
+	if p.current == nil ||
+		tok.AccessToken != p.current.AccessToken ||
+		tok.RefreshToken != p.current.RefreshToken {
+		p.current = tok
+		p.onRefresh(tok)
+	}
+
+	return tok, nil
+}
+
+// isPermanentTokenError returns whether the error means that the token can no
+// longer be refreshed and the user needs to authorize us again.
+func isPermanentTokenError(err error, current *oauth2.Token) bool {
+	var rErr *oauth2.RetrieveError
+	if errors.As(err, &rErr) {
+		switch retrieveErrorCode(rErr) {
+		case "invalid_grant", "invalid_client", "unauthorized_client":
+			return true
+		case "":
+			// Not a standard error response: only trust an explicit refusal.
+			return rErr.Response != nil && rErr.Response.StatusCode == http.StatusUnauthorized
+		}
+
+		return false
+	}
+
+	// The token expired and there is nothing to refresh it with.
+	return current != nil && !current.Valid() && current.RefreshToken == ""
+}
+
+// retrieveErrorCode returns the error code of a failed token request, which
+// the server sends either as JSON or, like the token itself, form-encoded.
+func retrieveErrorCode(err *oauth2.RetrieveError) string {
+	var body struct {
+		Error string `json:"error"`
+	}
+
+	if json.Unmarshal(err.Body, &body) == nil {
+		return body.Error
+	}
+
+	values, parseErr := url.ParseQuery(string(err.Body))
+	if parseErr != nil {
+		return ""
+	}
+
+	return values.Get("error")
+}
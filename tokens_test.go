@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestIsPermanentTokenError(t *testing.T) {
+	expired := &oauth2.Token{AccessToken: "a", Expiry: time.Now().Add(-time.Hour)}
+	refreshable := &oauth2.Token{AccessToken: "a", RefreshToken: "r", Expiry: time.Now().Add(-time.Hour)}
+	response := func(status int) *http.Response {
+		return &http.Response{StatusCode: status}
+	}
+
+	tests := []struct {
+		err       error
+		current   *oauth2.Token
+		permanent bool
+	}{
+		{&oauth2.RetrieveError{Response: response(400), Body: []byte(`{"error": "invalid_grant"}`)}, refreshable, true},
+		{&oauth2.RetrieveError{Response: response(400), Body: []byte("error=unauthorized_client")}, refreshable, true},
+		{&oauth2.RetrieveError{Response: response(503), Body: []byte(`{"error": "temporarily_unavailable"}`)}, refreshable, false},
+		{&oauth2.RetrieveError{Response: response(401), Body: []byte("Unauthorized")}, refreshable, true},
+		{&oauth2.RetrieveError{Response: response(502), Body: []byte("Bad Gateway")}, refreshable, false},
+		{errors.New("connection refused"), refreshable, false},
+		{errors.New("token expired and refresh token is not set"), expired, true},
+	}
+
+	for _, test := range tests {
+		if got := isPermanentTokenError(test.err, test.current); got != test.permanent {
+			t.Errorf("%v: expected %v, got %v", test.err, test.permanent, got)
+		}
+	}
+}
+
+func TestRefreshedTokenIsPersisted(t *testing.T) {
+	a, _, u := newTestApp(t, nil)
+
+	tokens, err := a.db.updateTokens(u.ProfileURL, func(t *userTokens) {
+		t.TraktToken = &oauth2.Token{AccessToken: "old", RefreshToken: "refresh", Expiry: time.Now().Add(-time.Hour)}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.userTokens = tokens
+
+	// A job holding a copy of the user from before the refresh.
+	stale, err := a.db.get(u.ProfileURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var history traktHistory
+	_, err = a.traktGet(u, "/sync/history", nil, &history)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.TraktToken.AccessToken == "old" {
+		t.Fatal("expected the token to be refreshed")
+	}
+
+	err = a.db.save(stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := a.db.get(u.ProfileURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stored.TraktToken.AccessToken != u.TraktToken.AccessToken {
+		t.Errorf("expected the refreshed token to be kept, got %s", stored.TraktToken.AccessToken)
+	}
+}
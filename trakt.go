@@ -34,6 +34,11 @@ type traktIDs struct {
 	TVDb  int    `json:"tvdb,omitempty"`
 }
 
+type traktSeason struct {
+	Number int      `json:"number"`
+	IDs    traktIDs `json:"ids"`
+}
+
 type traktHistoryItem struct {
 	ID        int64        `json:"id"`
 	WatchedAt time.Time    `json:"watched_at"`
@@ -46,64 +51,423 @@ type traktHistoryItem struct {
 
 type traktHistory []traktHistoryItem
 
-func traktToMicroformats(item traktHistoryItem) (interface{}, error) {
-	watch := map[string]interface{}{}
-	watch["trakt-watch-id"] = []int64{item.ID}
+func (item traktHistoryItem) title() string {
+	if item.Type == "episode" {
+		return fmt.Sprintf("%s (%s S%dE%d)", item.Episode.Title, item.Show.Title, item.Episode.Season, item.Episode.Number)
+	}
 
-	summary := ""
+	return item.Movie.Title
+}
 
+// traktID returns the Trakt ID of the watched movie or episode.
+func (item traktHistoryItem) traktID() int {
 	if item.Type == "episode" {
-		episodeOf := map[string]interface{}{}
-
-		episodeOf["name"] = []string{item.Show.Title}
-		episodeOf["url"] = []string{"https://trakt.tv/shows/" + item.Show.IDs.Slug}
-		episodeOf["published"] = []string{time.Date(item.Show.Year, 1, 1, 0, 0, 0, 0, time.UTC).Format(time.RFC3339)}
-		episodeOf["trakt-ids"] = item.Show.IDs
-
-		watch["name"] = []string{item.Episode.Title}
-		watch["url"] = []string{
-			"https://trakt.tv/shows/" +
-				item.Show.IDs.Slug +
-				"/seasons/" +
-				strconv.Itoa(item.Episode.Season) +
-				"/episodes/" +
-				strconv.Itoa(item.Episode.Number),
-		}
-		watch["episode"] = []int{item.Episode.Number}
-		watch["season"] = []int{item.Episode.Season}
-		watch["trakt-ids"] = item.Episode.IDs
-		watch["episode-of"] = []interface{}{
-			map[string]interface{}{
-				"type":       []string{"h-cite"},
-				"properties": episodeOf,
-			},
+		return item.Episode.IDs.Trakt
+	}
+
+	return item.Movie.IDs.Trakt
+}
+
+// traktWatching is what the user is watching right now, either through a
+// check-in or a scrobble.
+type traktWatching struct {
+	StartedAt time.Time    `json:"started_at"`
+	ExpiresAt time.Time    `json:"expires_at"`
+	Action    string       `json:"action"`
+	Type      string       `json:"type"`
+	Movie     traktMovie   `json:"movie"`
+	Episode   traktEpisode `json:"episode"`
+	Show      traktShow    `json:"show"`
+}
+
+// historyItem returns the history item the watch will become once finished.
+func (item traktWatching) historyItem() traktHistoryItem {
+	return traktHistoryItem{
+		WatchedAt: item.StartedAt,
+		Action:    item.Action,
+		Type:      item.Type,
+		Movie:     item.Movie,
+		Episode:   item.Episode,
+		Show:      item.Show,
+	}
+}
+
+type traktRating struct {
+	RatedAt time.Time    `json:"rated_at"`
+	Rating  int          `json:"rating"`
+	Type    string       `json:"type"`
+	Movie   traktMovie   `json:"movie"`
+	Show    traktShow    `json:"show"`
+	Season  traktSeason  `json:"season"`
+	Episode traktEpisode `json:"episode"`
+}
+
+type traktRatings []traktRating
+
+func (item traktRating) title() string {
+	switch item.Type {
+	case "show":
+		return item.Show.Title
+	case "season":
+		return fmt.Sprintf("%s Season %d", item.Show.Title, item.Season.Number)
+	case "episode":
+		return fmt.Sprintf("%s (%s S%dE%d)", item.Episode.Title, item.Show.Title, item.Episode.Season, item.Episode.Number)
+	default:
+		return item.Movie.Title
+	}
+}
+
+// traktID returns the Trakt ID of the rated item.
+func (item traktRating) traktID() int {
+	switch item.Type {
+	case "show":
+		return item.Show.IDs.Trakt
+	case "season":
+		return item.Season.IDs.Trakt
+	case "episode":
+		return item.Episode.IDs.Trakt
+	default:
+		return item.Movie.IDs.Trakt
+	}
+}
+
+type traktWatchlistItem struct {
+	ID       int64      `json:"id"`
+	ListedAt time.Time  `json:"listed_at"`
+	Notes    string     `json:"notes"`
+	Type     string     `json:"type"`
+	Movie    traktMovie `json:"movie"`
+	Show     traktShow  `json:"show"`
+}
+
+type traktWatchlist []traktWatchlistItem
+
+func (item traktWatchlistItem) title() string {
+	if item.Type == "show" {
+		return item.Show.Title
+	}
+
+	return item.Movie.Title
+}
+
+type traktComment struct {
+	ID        int64     `json:"id"`
+	ParentID  int64     `json:"parent_id"`
+	CreatedAt time.Time `json:"created_at"`
+	Comment   string    `json:"comment"`
+	Spoiler   bool      `json:"spoiler"`
+	Review    bool      `json:"review"`
+}
+
+type traktCommentItem struct {
+	Type    string       `json:"type"`
+	Comment traktComment `json:"comment"`
+	Movie   traktMovie   `json:"movie"`
+	Show    traktShow    `json:"show"`
+	Season  traktSeason  `json:"season"`
+	Episode traktEpisode `json:"episode"`
+}
+
+type traktComments []traktCommentItem
+
+func (item traktCommentItem) title() string {
+	switch item.Type {
+	case "show":
+		return item.Show.Title
+	case "season":
+		return fmt.Sprintf("%s Season %d", item.Show.Title, item.Season.Number)
+	case "episode":
+		return fmt.Sprintf("%s (%s S%dE%d)", item.Episode.Title, item.Show.Title, item.Episode.Season, item.Episode.Number)
+	default:
+		return item.Movie.Title
+	}
+}
+
+// traktToMicroformats converts a watch into an h-entry. Plays is how many times
+// the item was watched up to and including this watch, or zero if unknown.
+func traktToMicroformats(item traktHistoryItem, plays int) (map[string]interface{}, error) {
+	watch, err := watchProperties(item)
+	if err != nil {
+		return nil, err
+	}
+
+	watch["trakt-watch-id"] = []int64{item.ID}
+	summary := "Just watched: " + item.title()
+
+	properties := map[string]interface{}{
+		"published": []string{item.WatchedAt.Format(time.RFC3339)},
+		"watch-of":  []interface{}{hcite(watch)},
+	}
+
+	if plays > 0 {
+		properties["watch-count"] = []int{plays}
+		properties["rewatch"] = []bool{plays > 1}
+	}
+
+	if plays > 1 {
+		summary = fmt.Sprintf("Rewatched: %s (%s time)", item.title(), ordinal(plays))
+	}
+
+	properties["summary"] = []string{summary}
+
+	mf2 := map[string]interface{}{
+		"type":       []string{"h-entry"},
+		"properties": properties,
+	}
+
+	return mf2, nil
+}
+
+func traktWatchingToMicroformats(item traktWatching) (map[string]interface{}, error) {
+	watch, err := watchProperties(item.historyItem())
+	if err != nil {
+		return nil, err
+	}
+
+	summary := "Watching: " + item.historyItem().title()
+
+	mf2 := map[string]interface{}{
+		"type": []string{"h-entry"},
+		"properties": map[string]interface{}{
+			"published": []string{item.StartedAt.Format(time.RFC3339)},
+			"summary":   []string{summary},
+			"watch-of":  []interface{}{hcite(watch)},
+		},
+	}
+
+	return mf2, nil
+}
+
+func traktBingeToMicroformats(items traktHistory) (map[string]interface{}, error) {
+	watches := []interface{}{}
+	for _, item := range items {
+		if item.Type != "episode" {
+			return nil, errors.New("invalid type " + item.Type)
 		}
 
-		summary = fmt.Sprintf("Just watched: %s (%s S%dE%d)", item.Episode.Title, item.Show.Title, item.Episode.Season, item.Episode.Number)
-	} else if item.Type == "movie" {
-		watch["name"] = []string{item.Movie.Title}
-		watch["url"] = []string{"https://trakt.tv/movies/" + item.Movie.IDs.Slug}
-		watch["published"] = []string{time.Date(item.Movie.Year, 1, 1, 0, 0, 0, 0, time.UTC).Format(time.RFC3339)}
-		watch["trakt-ids"] = item.Movie.IDs
+		watch := episodeProperties(item.Show, item.Episode)
+		watch["trakt-watch-id"] = []int64{item.ID}
+		watches = append(watches, hcite(watch))
+	}
 
-		summary = "Just watched: " + item.Movie.Title
-	} else {
+	last := items[len(items)-1]
+	summary := fmt.Sprintf("Watched %s of %s", bingeRange(items), last.Show.Title)
+
+	mf2 := map[string]interface{}{
+		"type": []string{"h-entry"},
+		"properties": map[string]interface{}{
+			"published": []string{last.WatchedAt.Format(time.RFC3339)},
+			"summary":   []string{summary},
+			"watch-of":  watches,
+		},
+	}
+
+	return mf2, nil
+}
+
+func watchProperties(item traktHistoryItem) (map[string]interface{}, error) {
+	switch item.Type {
+	case "episode":
+		return episodeProperties(item.Show, item.Episode), nil
+	case "movie":
+		return movieProperties(item.Movie), nil
+	default:
+		return nil, errors.New("invalid type " + item.Type)
+	}
+}
+
+func traktRatingToMicroformats(item traktRating) (map[string]interface{}, error) {
+	var rated map[string]interface{}
+
+	switch item.Type {
+	case "movie":
+		rated = movieProperties(item.Movie)
+	case "show":
+		rated = showProperties(item.Show)
+	case "season":
+		rated = seasonProperties(item.Show, item.Season)
+	case "episode":
+		rated = episodeProperties(item.Show, item.Episode)
+	default:
 		return nil, errors.New("invalid type " + item.Type)
 	}
 
+	summary := fmt.Sprintf("Rated %s: %d/10", item.title(), item.Rating)
+
 	mf2 := map[string]interface{}{
-		"type": []string{"h-entry"},
+		"type": []string{"h-review"},
 		"properties": map[string]interface{}{
-			"published": []string{item.WatchedAt.Format(time.RFC3339)},
+			"published": []string{item.RatedAt.Format(time.RFC3339)},
 			"summary":   []string{summary},
-			"watch-of": []interface{}{
-				map[string]interface{}{
-					"type":       []string{"h-cite"},
-					"properties": watch,
-				},
-			},
+			"rating":    []int{item.Rating},
+			"best":      []int{10},
+			"worst":     []int{1},
+			"item":      []interface{}{hcite(rated)},
 		},
 	}
 
 	return mf2, nil
 }
+
+func traktWatchlistToMicroformats(item traktWatchlistItem) (map[string]interface{}, error) {
+	var listed map[string]interface{}
+
+	switch item.Type {
+	case "movie":
+		listed = movieProperties(item.Movie)
+	case "show":
+		listed = showProperties(item.Show)
+	default:
+		return nil, errors.New("invalid type " + item.Type)
+	}
+
+	listed["trakt-watchlist-id"] = []int64{item.ID}
+
+	properties := map[string]interface{}{
+		"published":   []string{item.ListedAt.Format(time.RFC3339)},
+		"summary":     []string{"Want to watch: " + item.title()},
+		"category":    []string{"watchlist"},
+		"bookmark-of": []interface{}{hcite(listed)},
+	}
+
+	if item.Notes != "" {
+		properties["content"] = []string{item.Notes}
+	}
+
+	mf2 := map[string]interface{}{
+		"type":       []string{"h-entry"},
+		"properties": properties,
+	}
+
+	return mf2, nil
+}
+
+func traktCommentToMicroformats(item traktCommentItem) (map[string]interface{}, error) {
+	var inReplyTo string
+
+	switch item.Type {
+	case "movie":
+		inReplyTo = movieURL(item.Movie)
+	case "show":
+		inReplyTo = showURL(item.Show)
+	case "season":
+		inReplyTo = seasonURL(item.Show, item.Season.Number)
+	case "episode":
+		inReplyTo = episodeURL(item.Show, item.Episode)
+	default:
+		return nil, errors.New("invalid type " + item.Type)
+	}
+
+	if item.Comment.ParentID != 0 {
+		// A reply to another comment.
+		inReplyTo = "https://trakt.tv/comments/" + strconv.FormatInt(item.Comment.ParentID, 10)
+	}
+
+	properties := map[string]interface{}{
+		"published":        []string{item.Comment.CreatedAt.Format(time.RFC3339)},
+		"content":          []string{item.Comment.Comment},
+		"in-reply-to":      []string{inReplyTo},
+		"trakt-comment-id": []int64{item.Comment.ID},
+	}
+
+	categories := []string{}
+	if item.Comment.Review {
+		categories = append(categories, "review")
+	}
+	if item.Comment.Spoiler {
+		categories = append(categories, "spoiler")
+	}
+	if len(categories) > 0 {
+		properties["category"] = categories
+	}
+
+	mf2 := map[string]interface{}{
+		"type":       []string{"h-entry"},
+		"properties": properties,
+	}
+
+	return mf2, nil
+}
+
+func hcite(properties map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"type":       []string{"h-cite"},
+		"properties": properties,
+	}
+}
+
+// ordinal returns the number followed by its English ordinal suffix, e.g., 2nd.
+func ordinal(n int) string {
+	suffix := "th"
+	if n%100 < 11 || n%100 > 13 {
+		switch n % 10 {
+		case 1:
+			suffix = "st"
+		case 2:
+			suffix = "nd"
+		case 3:
+			suffix = "rd"
+		}
+	}
+
+	return strconv.Itoa(n) + suffix
+}
+
+func yearToPublished(year int) []string {
+	return []string{time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC).Format(time.RFC3339)}
+}
+
+func movieURL(movie traktMovie) string {
+	return "https://trakt.tv/movies/" + movie.IDs.Slug
+}
+
+func showURL(show traktShow) string {
+	return "https://trakt.tv/shows/" + show.IDs.Slug
+}
+
+func seasonURL(show traktShow, season int) string {
+	return showURL(show) + "/seasons/" + strconv.Itoa(season)
+}
+
+func episodeURL(show traktShow, episode traktEpisode) string {
+	return seasonURL(show, episode.Season) + "/episodes/" + strconv.Itoa(episode.Number)
+}
+
+func movieProperties(movie traktMovie) map[string]interface{} {
+	return map[string]interface{}{
+		"name":      []string{movie.Title},
+		"url":       []string{movieURL(movie)},
+		"published": yearToPublished(movie.Year),
+		"trakt-ids": movie.IDs,
+	}
+}
+
+func showProperties(show traktShow) map[string]interface{} {
+	return map[string]interface{}{
+		"name":      []string{show.Title},
+		"url":       []string{showURL(show)},
+		"published": yearToPublished(show.Year),
+		"trakt-ids": show.IDs,
+	}
+}
+
+func seasonProperties(show traktShow, season traktSeason) map[string]interface{} {
+	return map[string]interface{}{
+		"name":      []string{fmt.Sprintf("%s Season %d", show.Title, season.Number)},
+		"url":       []string{seasonURL(show, season.Number)},
+		"season":    []int{season.Number},
+		"trakt-ids": season.IDs,
+		"season-of": []interface{}{hcite(showProperties(show))},
+	}
+}
+
+func episodeProperties(show traktShow, episode traktEpisode) map[string]interface{} {
+	return map[string]interface{}{
+		"name":       []string{episode.Title},
+		"url":        []string{episodeURL(show, episode)},
+		"episode":    []int{episode.Number},
+		"season":     []int{episode.Season},
+		"trakt-ids":  episode.IDs,
+		"episode-of": []interface{}{hcite(showProperties(show))},
+	}
+}
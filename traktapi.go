@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxRetryAfter is the longest Retry-After we are willing to wait for before
+// trying a request again. Longer waits are returned as a traktRateLimitError.
+const maxRetryAfter = time.Second * 30
+
+var errTraktUnauthorized = errors.New("trakt: unauthorized, trakt must be reconnected")
+
+type traktRateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *traktRateLimitError) Error() string {
+	return "trakt: rate limited, retry after " + e.RetryAfter.String()
+}
+
+type traktServerError struct {
+	StatusCode int
+}
+
+func (e *traktServerError) Error() string {
+	return "trakt: server error " + strconv.Itoa(e.StatusCode)
+}
+
+type traktStatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *traktStatusError) Error() string {
+	return "trakt: status " + strconv.Itoa(e.StatusCode) + " body: " + e.Body
+}
+
+// isTraktNotFound returns whether Trakt says what was asked for does not exist,
+// e.g., a movie that was removed from it. Asking again will not help.
+func isTraktNotFound(err error) bool {
+	var sErr *traktStatusError
+	return errors.As(err, &sErr) &&
+		(sErr.StatusCode == http.StatusNotFound || sErr.StatusCode == http.StatusGone)
+}
+
+// traktClient makes requests to the Trakt API. It is shared by every user so
+// that the rate limits, which apply to our application, are respected.
+type traktClient struct {
+	apiURL   string
+	clientID string
+	limiter  *rateLimiter
+}
+
+func newTraktClient(apiURL, clientID string, requestsPerSecond float64) *traktClient {
+	return &traktClient{
+		apiURL:   apiURL,
+		clientID: clientID,
+		limiter:  newRateLimiter(requestsPerSecond, 10),
+	}
+}
+
+// get requests the path with the given query using the user's HTTP client and
+// decodes the response into v. The response headers are returned so that the
+// pagination can be read.
+func (t *traktClient) get(httpClient *http.Client, path string, query url.Values, v interface{}) (http.Header, error) {
+	u, err := url.Parse(t.apiURL + path)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = query.Encode()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	for {
+		err = t.limiter.wait(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("trakt-api-key", t.clientID)
+		req.Header.Set("trakt-api-version", "2")
+
+		res, err := httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		t.checkRateLimit(res.Header)
+
+		if res.StatusCode == http.StatusTooManyRequests {
+			res.Body.Close()
+
+			retryAfter := parseRetryAfter(res.Header.Get("Retry-After"))
+			t.limiter.pause(time.Now().Add(retryAfter))
+
+			if retryAfter > maxRetryAfter {
+				return nil, &traktRateLimitError{RetryAfter: retryAfter}
+			}
+
+			continue
+		}
+
+		defer res.Body.Close()
+
+		switch {
+		case res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden:
+			return nil, errTraktUnauthorized
+		case res.StatusCode >= 500:
+			return nil, &traktServerError{StatusCode: res.StatusCode}
+		case res.StatusCode == http.StatusNoContent:
+			return res.Header, nil
+		case res.StatusCode < 200 || res.StatusCode >= 300:
+			body, _ := ioutil.ReadAll(res.Body)
+			return nil, &traktStatusError{StatusCode: res.StatusCode, Body: string(body)}
+		}
+
+		return res.Header, json.NewDecoder(res.Body).Decode(v)
+	}
+}
+
+// hasNextPage reads the pagination headers and returns whether there are more
+// pages after the current one.
+func hasNextPage(header http.Header) (bool, error) {
+	currentPage, err := strconv.Atoi(header.Get("X-Pagination-Page"))
+	if err != nil {
+		return false, err
+	}
+
+	totalPages, err := strconv.Atoi(header.Get("X-Pagination-Page-Count"))
+	if err != nil {
+		return false, err
+	}
+
+	return currentPage < totalPages, nil
+}
+
+// checkRateLimit pauses all requests if the X-Ratelimit header says that there
+// are no requests left.
+func (t *traktClient) checkRateLimit(header http.Header) {
+	raw := header.Get("X-Ratelimit")
+	if raw == "" {
+		return
+	}
+
+	var limit struct {
+		Remaining int       `json:"remaining"`
+		Until     time.Time `json:"until"`
+	}
+
+	err := json.Unmarshal([]byte(raw), &limit)
+	if err != nil {
+		return
+	}
+
+	if limit.Remaining <= 0 && !limit.Until.IsZero() {
+		t.limiter.pause(limit.Until)
+	}
+}
+
+// parseRetryAfter parses a Retry-After header, which may either be a number of
+// seconds or a date. Defaults to one second.
+func parseRetryAfter(value string) time.Duration {
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+
+	return time.Second
+}
+
+// rateLimiter is a token bucket that can be paused until a certain time.
+type rateLimiter struct {
+	mu          sync.Mutex
+	rate        float64
+	burst       float64
+	tokens      float64
+	last        time.Time
+	pausedUntil time.Time
+}
+
+func newRateLimiter(rate, burst float64) *rateLimiter {
+	return &rateLimiter{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// wait blocks until a request can be made, or the context is done.
+func (l *rateLimiter) wait(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		now := time.Now()
+
+		var delay time.Duration
+		if now.Before(l.pausedUntil) {
+			delay = l.pausedUntil.Sub(now)
+
+			if deadline, ok := ctx.Deadline(); ok && l.pausedUntil.After(deadline) {
+				l.mu.Unlock()
+				return &traktRateLimitError{RetryAfter: delay}
+			}
+		} else {
+			l.tokens += now.Sub(l.last).Seconds() * l.rate
+			if l.tokens > l.burst {
+				l.tokens = l.burst
+			}
+			l.last = now
+
+			if l.tokens >= 1 {
+				l.tokens--
+				l.mu.Unlock()
+				return nil
+			}
+
+			delay = time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+		}
+		l.mu.Unlock()
+
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+func (l *rateLimiter) pause(until time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterBurst(t *testing.T) {
+	l := newRateLimiter(20, 2)
+	ctx := context.Background()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := l.wait(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The burst is immediate, the third request waits for a new token.
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("expected the third request to wait, took %v", elapsed)
+	}
+}
+
+func TestRateLimiterPause(t *testing.T) {
+	l := newRateLimiter(100, 10)
+	l.pause(time.Now().Add(time.Hour))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	err := l.wait(ctx)
+
+	var rErr *traktRateLimitError
+	if !errors.As(err, &rErr) {
+		t.Fatalf("expected a rate limit error, got %v", err)
+	}
+
+	if rErr.RetryAfter < 59*time.Minute {
+		t.Errorf("expected to retry after the pause, got %v", rErr.RetryAfter)
+	}
+
+	// Shorter pauses are waited for.
+	l = newRateLimiter(100, 10)
+	l.pause(time.Now().Add(50 * time.Millisecond))
+
+	start := time.Now()
+	if err := l.wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("expected to wait for the pause, took %v", elapsed)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if d := parseRetryAfter("120"); d != 2*time.Minute {
+		t.Errorf("expected 2m, got %v", d)
+	}
+
+	if d := parseRetryAfter(""); d != time.Second {
+		t.Errorf("expected the default of 1s, got %v", d)
+	}
+
+	if d := parseRetryAfter("-5"); d != time.Second {
+		t.Errorf("expected the default of 1s, got %v", d)
+	}
+
+	date := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	if d := parseRetryAfter(date); d < 59*time.Minute || d > time.Hour {
+		t.Errorf("expected about 1h, got %v", d)
+	}
+}
+
+func TestTraktClientRetriesAfterTooManyRequests(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+
+		w.Write([]byte(`{"ok": true}`))
+	}))
+	defer server.Close()
+
+	client := newTraktClient(server.URL, "client-id", 100)
+
+	var v struct{ OK bool }
+	_, err := client.get(server.Client(), "/test", nil, &v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if requests != 2 || !v.OK {
+		t.Errorf("expected the request to be retried once, got %d requests", requests)
+	}
+}
+
+func TestTraktClientLongRetryAfter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	client := newTraktClient(server.URL, "client-id", 100)
+
+	_, err := client.get(server.Client(), "/test", nil, nil)
+
+	var rErr *traktRateLimitError
+	if !errors.As(err, &rErr) || rErr.RetryAfter != time.Hour {
+		t.Errorf("expected to be told to retry after 1h, got %v", err)
+	}
+}
+
+func TestCheckRateLimit(t *testing.T) {
+	client := newTraktClient("", "client-id", 100)
+	until := time.Now().Add(time.Hour).UTC()
+
+	header := http.Header{}
+	header.Set("X-Ratelimit", `{"remaining": 0, "until": "`+until.Format(time.RFC3339)+`"}`)
+	client.checkRateLimit(header)
+
+	if client.limiter.pausedUntil.Before(until.Add(-time.Second)) {
+		t.Errorf("expected requests to be paused until %v, got %v", until, client.limiter.pausedUntil)
+	}
+}
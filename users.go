@@ -7,14 +7,80 @@ import (
 	"golang.org/x/oauth2"
 )
 
+// userTokens are the tokens of the user. They are only changed with
+// updateTokens, so that saving an outdated copy of the user does not bring back
+// a token that was since rotated.
+type userTokens struct {
+	IndieToken      *oauth2.Token
+	IndieTokenError string
+	TraktToken      *oauth2.Token
+	TraktTokenError string
+}
+
+// userSettings are what the user chooses, such as their schedule, and what we
+// know about their Micropub endpoint. They are only changed with updateSettings,
+// so that a job saving its copy of the user does not undo what changed meanwhile.
+type userSettings struct {
+	DeleteRemoved        bool
+	ImportInterval       time.Duration
+	Paused               bool
+	NextRunAt            time.Time
+	ImportRatings        bool
+	ImportWatchlist      bool
+	ImportComments       bool
+	LiveWatching         bool
+	AggregateBinges      bool
+	Templates            postTemplates
+	EnrichMetadata       bool
+	UploadPhotos         bool
+	MicropubConfig       *micropubConfig
+	MicropubConfigAt     time.Time
+	SyndicateTo          []string
+	PostStatus           string
+	Visibility           string
+	PostRules            postRules
+	MicropubMode         string
+	DetectedMicropubMode string
+	Filters              []filterRule
+	Timezone             string
+}
+
 type user struct {
-	ProfileURL        string
-	IndieAuthMetadata indieauth.Metadata
-	MicropubEndpoint  string
-	IndieToken        *oauth2.Token
-	TraktToken        *oauth2.Token
-	NewestFetchedTime time.Time
-	NewestFetchedID   int64
-	OldestFetchedTime time.Time
-	OldestFetchedID   int64
+	ProfileURL           string
+	IndieAuthMetadata    indieauth.Metadata
+	MicropubEndpoint     string
+	NewestFetchedTime    time.Time
+	NewestFetchedID      int64
+	OldestFetchedTime    time.Time
+	OldestFetchedID      int64
+	ReconcileFrom        time.Time
+	PreLedger            bool
+	LastReconciledAt     time.Time
+	FailureCount         int
+	RetryAt              time.Time
+	RatingsFetchedTime   time.Time
+	WatchlistFetchedTime time.Time
+	CommentsFetchedTime  time.Time
+	LiveWatches          []*watchingState
+	Binge                *bingeState
+	BulkImport           *bulkImport
+
+	userSettings
+	userTokens
+}
+
+// startImports makes the imports of ratings, the watchlist and comments that are
+// enabled, but never ran, start from now, like the history.
+func (u *user) startImports(now time.Time) {
+	if u.ImportRatings && u.RatingsFetchedTime.IsZero() {
+		u.RatingsFetchedTime = now
+	}
+
+	if u.ImportWatchlist && u.WatchlistFetchedTime.IsZero() {
+		u.WatchlistFetchedTime = now
+	}
+
+	if u.ImportComments && u.CommentsFetchedTime.IsZero() {
+		u.CommentsFetchedTime = now
+	}
 }
@@ -32,3 +32,17 @@ func randString(n int) string {
 
 	return *(*string)(unsafe.Pointer(&b))
 }
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func inc(i int) int {
+	return i + 1
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// watchingGrace is for how long after a check-in or scrobble expires we still
+// wait for the history item that finishes it, before forgetting about it.
+const watchingGrace = time.Hour * 24
+
+// watchingState is a post created when the user started watching something,
+// waiting for the history item that finishes it.
+type watchingState struct {
+	Type      string
+	TraktID   int
+	Action    string
+	StartedAt time.Time
+	ExpiresAt time.Time
+	Location  string
+}
+
+func watchingKey(item traktHistoryItem) string {
+	return fmt.Sprintf("%s-%d-%d", item.Type, item.traktID(), item.WatchedAt.Unix())
+}
+
+func (w *watchingState) key() string {
+	return fmt.Sprintf("%s-%d-%d", w.Type, w.TraktID, w.StartedAt.Unix())
+}
+
+// watchingFor returns the live post that the item finishes, if there is one:
+// the last one of the same movie or episode started before the item was watched.
+func (u *user) watchingFor(item traktHistoryItem) *watchingState {
+	var found *watchingState
+
+	for _, w := range u.LiveWatches {
+		if w.Type != item.Type || w.TraktID != item.traktID() || item.WatchedAt.Before(w.StartedAt) {
+			continue
+		}
+
+		if found == nil || w.StartedAt.After(found.StartedAt) {
+			found = w
+		}
+	}
+
+	return found
+}
+
+// forgetWatching removes the live post from the ones waiting to be finished.
+func (u *user) forgetWatching(w *watchingState) {
+	watches := []*watchingState{}
+	for _, other := range u.LiveWatches {
+		if other != w {
+			watches = append(watches, other)
+		}
+	}
+	u.LiveWatches = watches
+}
+
+// finishWatches posts the final watch of the items. If one of them has a live
+// post, it is updated instead of creating a new post. Every live post of the
+// items is then forgotten, as the final watch replaces them.
+func (a *app) finishWatches(user *user, items traktHistory, mf2 map[string]interface{}) (string, error) {
+	var live *watchingState
+	finished := map[*watchingState]bool{}
+
+	for _, item := range items {
+		w := user.watchingFor(item)
+		if w == nil {
+			continue
+		}
+
+		finished[w] = true
+		if live == nil && w.Location != "" {
+			live = w
+		}
+	}
+
+	var location string
+	var err error
+
+	if live != nil {
+		location = live.Location
+		err = a.updateMicropub(user, location, mf2)
+	} else {
+		location, err = a.createMicropub(user, mf2)
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	if len(finished) > 0 {
+		for w := range finished {
+			user.forgetWatching(w)
+		}
+
+		err = a.db.save(user)
+		if err != nil {
+			log.Printf("%s - could not save user: %v\n", user.ProfileURL, err)
+		}
+	}
+
+	return location, nil
+}
+
+// endWatching forgets about the live posts, other than the one with the current
+// key, that will not be finished: check-ins that are no longer being watched
+// before they expire, i.e., that were cancelled, and anything not finished in
+// time. If the user wants posts of removed items deleted, they are deleted.
+func (a *app) endWatching(user *user, current string) {
+	now := time.Now()
+
+	for _, w := range user.LiveWatches {
+		cancelled := w.Action == "checkin" && now.Before(w.ExpiresAt)
+		expired := now.After(w.ExpiresAt.Add(watchingGrace))
+		if w.key() == current || (!cancelled && !expired) {
+			continue
+		}
+
+		if user.DeleteRemoved {
+			err := a.deleteWatching(user, w)
+			if err != nil {
+				// Try again next time.
+				log.Printf("%s - could not delete %s: %v\n", user.ProfileURL, w.Location, err)
+				continue
+			}
+		}
+
+		user.forgetWatching(w)
+		err := a.db.save(user)
+		if err != nil {
+			log.Printf("%s - could not save user: %v\n", user.ProfileURL, err)
+		}
+	}
+}
+
+// deleteWatching deletes the live post and records it in the ledger.
+func (a *app) deleteWatching(user *user, w *watchingState) error {
+	d, err := a.db.getDelivery(user.ProfileURL, watchingKind, w.key())
+	if err != nil {
+		return err
+	}
+
+	err = a.deleteMicropub(user, w.Location)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("%s - deleted %s, it was not finished\n", user.ProfileURL, w.Location)
+	if d == nil {
+		return nil
+	}
+
+	d.Status = deliveryDeleted
+	d.Error = ""
+	return a.db.saveDelivery(user.ProfileURL, d)
+}
+
+// checkWatching posts what the user is watching on Trakt right now, if it was
+// not posted yet.
+func (a *app) checkWatching(user *user) {
+	if !user.LiveWatching || time.Now().Before(user.RetryAt) {
+		return
+	}
+
+	var watching traktWatching
+	_, err := a.traktGet(user, "/users/me/watching", nil, &watching)
+	if err != nil {
+		log.Printf("%s - could not fetch watching: %v\n", user.ProfileURL, err)
+		return
+	}
+
+	if watching.StartedAt.IsZero() {
+		// Nothing is being watched.
+		a.endWatching(user, "")
+		return
+	}
+
+	item := watching.historyItem()
+	d := &delivery{
+		Key:   watchingKey(item),
+		Kind:  watchingKind,
+		Title: item.title(),
+		Date:  watching.StartedAt,
+	}
+
+	a.endWatching(user, d.Key)
+
+	existing, err := a.db.getDelivery(user.ProfileURL, watchingKind, d.Key)
+	if err != nil {
+		log.Printf("%s - could not get delivery: %v\n", user.ProfileURL, err)
+		return
+	}
+
+	if existing != nil {
+		// Already posted, or skipped.
+		return
+	}
+
+	d.Reason, err = a.filterReason(user, item)
+	if err != nil {
+		log.Printf("%s - could not evaluate rules: %v\n", user.ProfileURL, err)
+		return
+	}
+
+	if d.Reason != "" {
+		// Recorded, so that the rules are not evaluated again.
+		d.Status = deliverySkipped
+		err = a.db.saveDelivery(user.ProfileURL, d)
+		if err != nil {
+			log.Printf("%s - could not save delivery: %v\n", user.ProfileURL, err)
+		}
+		return
+	}
+
+	micro, err := traktWatchingToMicroformats(watching)
+	if err != nil {
+		log.Printf("%s - could not convert watching: %v\n", user.ProfileURL, err)
+		return
+	}
+
+	applyPostRule(user.PostRules, item.Type, micro)
+
+	location, err := a.createMicropub(user, micro)
+	if err != nil {
+		// Not recorded: it is tried again the next time.
+		log.Printf("%s - could not send micropub: %v\n", user.ProfileURL, err)
+		return
+	}
+
+	if location != "" {
+		user.LiveWatches = append(user.LiveWatches, &watchingState{
+			Type:      item.Type,
+			TraktID:   item.traktID(),
+			Action:    watching.Action,
+			StartedAt: watching.StartedAt,
+			ExpiresAt: watching.ExpiresAt,
+			Location:  location,
+		})
+
+		err = a.db.save(user)
+		if err != nil {
+			log.Printf("%s - could not save user: %v\n", user.ProfileURL, err)
+		}
+	} else {
+		// Without its URL, the post cannot be updated: the final watch is posted on
+		// its own.
+		log.Printf("%s - micropub endpoint did not return the location of the live post\n", user.ProfileURL)
+	}
+
+	d.Status = deliveryDelivered
+	d.Location = location
+	d.Attempts = 1
+	err = a.db.saveDelivery(user.ProfileURL, d)
+	if err != nil {
+		log.Printf("%s - could not save delivery: %v\n", user.ProfileURL, err)
+	}
+}
+
+// pollWatching checks what the users with live watching enabled are watching
+// every watching interval, until the context is done.
+func (a *app) pollWatching(ctx context.Context) {
+	ticker := time.NewTicker(a.WatchingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		users, err := a.db.getAll()
+		if err != nil {
+			log.Printf("error while getting users: %v\n", err)
+			continue
+		}
+
+		for _, user := range users {
+			canCheck := user.LiveWatching && !user.Paused &&
+				user.IndieToken != nil && user.TraktToken != nil &&
+				user.IndieTokenError == "" && user.TraktTokenError == ""
+
+			if canCheck {
+				// Skipped if the user is being imported. We will check again soon.
+				a.submit(user.ProfileURL, a.checkWatching)
+			}
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// startWatching makes the fake Trakt say the user is watching the item, since a
+// minute ago, through a check-in or a scrobble.
+func startWatching(a *app, item traktHistoryItem, action string) {
+	a.fakeTrakt.mu.Lock()
+	defer a.fakeTrakt.mu.Unlock()
+
+	startedAt := time.Now().Add(-time.Minute).UTC().Truncate(time.Second)
+	a.fakeTrakt.watching = &traktWatching{
+		StartedAt: startedAt,
+		ExpiresAt: startedAt.Add(time.Hour),
+		Action:    action,
+		Type:      item.Type,
+		Movie:     item.Movie,
+		Show:      item.Show,
+		Episode:   item.Episode,
+	}
+}
+
+func stopWatching(a *app) {
+	a.fakeTrakt.mu.Lock()
+	defer a.fakeTrakt.mu.Unlock()
+
+	a.fakeTrakt.watching = nil
+}
+
+// finishWatching adds the item to the fake Trakt history, as if it was just
+// watched.
+func finishWatching(a *app, item traktHistoryItem) {
+	stopWatching(a)
+
+	item.ID = 0
+	item.WatchedAt = time.Now().UTC().Truncate(time.Second)
+	a.fakeTrakt.add(item)
+}
+
+func TestLiveWatchIsFinished(t *testing.T) {
+	a, mp, u := newTestApp(t, func(s *userSettings) {
+		s.LiveWatching = true
+	})
+	a.importTrakt(u, false, false, 0)
+
+	movie := historyItem(t, a, 1)
+	startWatching(a, movie, "scrobble")
+	a.checkWatching(u)
+	a.checkWatching(u)
+
+	posts, _ := mp.received()
+	if len(posts) != 6 || summary(posts[5]) != "Watching: Fake Movie 1" {
+		t.Fatalf("expected the live watch to be posted once, got %d posts", len(posts))
+	}
+
+	if len(u.LiveWatches) != 1 {
+		t.Fatalf("expected the live post to wait for its watch, got %v", u.LiveWatches)
+	}
+
+	finishWatching(a, movie)
+	a.importTrakt(u, false, false, 0)
+
+	posts, _ = mp.received()
+	if len(posts) != 7 || posts[6]["action"] != "update" || posts[6]["url"] != "https://me.example/posts/6" {
+		t.Fatalf("expected the live post to be updated, got %v", posts[len(posts)-1])
+	}
+
+	if len(u.LiveWatches) != 0 {
+		t.Errorf("expected the live post to be forgotten, got %v", u.LiveWatches)
+	}
+}
+
+func TestLiveWatchWithoutLocation(t *testing.T) {
+	a, mp, u := newTestApp(t, func(s *userSettings) {
+		s.LiveWatching = true
+	})
+	a.importTrakt(u, false, false, 0)
+	mp.noLocation = true
+
+	movie := historyItem(t, a, 1)
+	startWatching(a, movie, "scrobble")
+	a.checkWatching(u)
+
+	if len(u.LiveWatches) != 0 {
+		t.Fatalf("expected a live post without URL not to be kept, got %v", u.LiveWatches)
+	}
+
+	finishWatching(a, movie)
+	a.importTrakt(u, false, false, 0)
+
+	posts, _ := mp.received()
+	if len(posts) != 7 || posts[6]["action"] != nil || summary(posts[6]) != "Rewatched: Fake Movie 1 (2nd time)" {
+		t.Errorf("expected the watch to be posted on its own, got %v", posts[len(posts)-1])
+	}
+}
+
+func TestLiveWatchCancelled(t *testing.T) {
+	a, mp, u := newTestApp(t, func(s *userSettings) {
+		s.LiveWatching = true
+		s.DeleteRemoved = true
+	})
+
+	startWatching(a, historyItem(t, a, 1), "checkin")
+	a.checkWatching(u)
+
+	// Another check-in replaces the first one before it expires.
+	startWatching(a, historyItem(t, a, 2), "checkin")
+	a.checkWatching(u)
+
+	posts, _ := mp.received()
+	if len(posts) != 3 || posts[1]["action"] != "delete" || posts[1]["url"] != "https://me.example/posts/1" {
+		t.Fatalf("expected the cancelled check-in to be deleted, got %d posts", len(posts))
+	}
+
+	if len(u.LiveWatches) != 1 {
+		t.Errorf("expected only the second check-in to be kept, got %v", u.LiveWatches)
+	}
+}
+
+func TestBingeFinishesEveryLiveWatch(t *testing.T) {
+	a, mp, u := newTestApp(t, func(s *userSettings) {
+		s.LiveWatching = true
+		s.AggregateBinges = true
+	})
+
+	// The first two episodes of the binge were posted live.
+	for _, id := range []int64{4, 5} {
+		item := historyItem(t, a, id)
+		u.LiveWatches = append(u.LiveWatches, &watchingState{
+			Type:      item.Type,
+			TraktID:   item.traktID(),
+			Action:    "scrobble",
+			StartedAt: item.WatchedAt.Add(-time.Hour),
+			ExpiresAt: item.WatchedAt,
+			Location:  "https://me.example/live/" + historyKey(id),
+		})
+	}
+
+	a.importTrakt(u, false, false, 0)
+	a.BingeGap = 30 * time.Minute
+	a.flushDueBinge(u)
+
+	posts, _ := mp.received()
+	if len(posts) != 1 || posts[0]["action"] != "update" || posts[0]["url"] != "https://me.example/live/4" {
+		t.Fatalf("expected the first live post to be updated with the binge, got %v", posts)
+	}
+
+	if len(u.LiveWatches) != 0 {
+		t.Errorf("expected every live post of the binge to be forgotten, got %v", u.LiveWatches)
+	}
+}
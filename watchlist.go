@@ -0,0 +1,84 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strconv"
+)
+
+func watchlistKey(id int64) string {
+	return strconv.FormatInt(id, 10)
+}
+
+func newWatchlistDelivery(item traktWatchlistItem) *delivery {
+	return &delivery{
+		Key:       watchlistKey(item.ID),
+		Kind:      watchlistKind,
+		Title:     item.title(),
+		Date:      item.ListedAt,
+		Watchlist: &item,
+	}
+}
+
+func (a *app) deliverWatchlistItem(user *user, item traktWatchlistItem) (bool, error) {
+	return a.deliver(user, newWatchlistDelivery(item), func() (string, error) {
+		micro, err := traktWatchlistToMicroformats(item)
+		if err != nil {
+			return "", &conversionError{err}
+		}
+
+		return a.createMicropub(user, micro)
+	})
+}
+
+// importWatchlist sends the movies and shows added to the watchlist since the
+// last imported one, oldest first. If limit is not zero, it stops after handling
+// that many items.
+func (a *app) importWatchlist(user *user, limit int) {
+	var watchlist traktWatchlist
+	_, err := a.traktGet(user, "/sync/watchlist", nil, &watchlist)
+	if err != nil {
+		log.Printf("%s - could not fetch trakt watchlist: %v\n", user.ProfileURL, err)
+		return
+	}
+
+	sort.SliceStable(watchlist, func(i, j int) bool {
+		return watchlist[i].ListedAt.Before(watchlist[j].ListedAt)
+	})
+
+	handledCount := 0
+
+	for _, item := range watchlist {
+		if item.ListedAt.Before(user.WatchlistFetchedTime) {
+			continue
+		}
+
+		if item.Type != "movie" && item.Type != "show" {
+			// Seasons and episodes can also be watchlisted.
+			continue
+		}
+
+		handled, err := a.deliverWatchlistItem(user, item)
+		if err != nil {
+			log.Printf("%s - could not send micropub: %v\n", user.ProfileURL, err)
+			return
+		}
+
+		if !handled {
+			continue
+		}
+
+		user.WatchlistFetchedTime = item.ListedAt
+
+		err = a.db.save(user)
+		if err != nil {
+			log.Printf("%s - could not save user: %v\n", user.ProfileURL, err)
+			return
+		}
+
+		handledCount++
+		if limit > 0 && handledCount >= limit {
+			return
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// property returns the values of a property of a post sent as JSON.
+func property(post map[string]interface{}, name string) []interface{} {
+	properties, _ := post["properties"].(map[string]interface{})
+	values, _ := properties[name].([]interface{})
+	return values
+}
+
+func TestImportWatchlist(t *testing.T) {
+	a, mp, u := newTestApp(t, func(s *userSettings) {
+		s.ImportWatchlist = true
+	})
+	u = startImportsAt(t, a, u, time.Now().Add(-2*time.Hour))
+
+	a.importWatchlist(u, 0)
+	a.importWatchlist(u, 0)
+
+	posts, _ := mp.received()
+	if len(posts) != 1 {
+		t.Fatalf("expected the watchlist addition to be posted once, got %d posts", len(posts))
+	}
+
+	if summary(posts[0]) != "Want to watch: Fake Movie 2" || len(property(posts[0], "bookmark-of")) != 1 {
+		t.Errorf("expected a bookmark of the movie, got %v", posts[0])
+	}
+
+	item := a.fakeTrakt.watchlist[0]
+	d, err := a.db.getDelivery(u.ProfileURL, watchlistKind, watchlistKey(item.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d == nil || d.Status != deliveryDelivered {
+		t.Errorf("expected the addition to be in the ledger, got %+v", d)
+	}
+}
+
+func TestImportWatchlistSkipsSeasons(t *testing.T) {
+	a, mp, u := newTestApp(t, func(s *userSettings) {
+		s.ImportWatchlist = true
+	})
+	u = startImportsAt(t, a, u, time.Now().Add(-2*time.Hour))
+
+	// Seasons and episodes can be added to the watchlist too.
+	show := historyItem(t, a, 4).Show
+	a.fakeTrakt.mu.Lock()
+	a.fakeTrakt.watchlist = append(a.fakeTrakt.watchlist, traktWatchlistItem{
+		ID:       100,
+		ListedAt: time.Now().Add(-time.Minute),
+		Type:     "season",
+		Show:     show,
+	})
+	a.fakeTrakt.mu.Unlock()
+
+	a.importWatchlist(u, 0)
+
+	posts, _ := mp.received()
+	if len(posts) != 1 {
+		t.Errorf("expected only the movie to be posted, got %d posts", len(posts))
+	}
+}